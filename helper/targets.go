@@ -7,27 +7,187 @@ import (
 )
 
 type Target struct {
-	Targets []string `json:"targets"`
+	Targets      []TargetSpec        `json:"targets"`
+	Pools        map[string]PoolSpec `json:"pools,omitempty"`
+	VirtualHosts []VirtualHostSpec   `json:"virtual_hosts,omitempty"`
+	TCPListeners []TCPListenerSpec   `json:"tcp_listeners,omitempty"`
+}
+
+// TCPListenerSpec relays the raw TCP connections accepted on Listen
+// ("host:port" or ":port") to a pool of "tcp://host:port" targets.
+// IdleTimeout uses Go duration syntax and overrides TCP_IDLE_TIMEOUT.
+type TCPListenerSpec struct {
+	Listen      string `json:"listen"`
+	Pool        string `json:"pool"`
+	IdleTimeout string `json:"idle_timeout,omitempty"`
+}
+
+// PoolSpec is a named group of targets with its own load balancing strategy.
+// The top level "targets" list forms the pool named "default".
+type PoolSpec struct {
+	Targets  []TargetSpec `json:"targets"`
+	Strategy string       `json:"strategy,omitempty"`
+}
+
+// VirtualHostSpec groups the routes served for a set of host names. Host names
+// are exact ("api.example.com"), wildcard subdomains ("*.example.com") or "*".
+type VirtualHostSpec struct {
+	Hosts  []string    `json:"hosts"`
+	Routes []RouteSpec `json:"routes"`
+}
+
+// RouteSpec sends the requests matching a path prefix or a path regular
+// expression to a pool. A route without either matches every path. Instead of
+// a single pool a route can split its traffic by weight across several pools,
+// and overrides force a pool for requests carrying a header, cookie or query
+// parameter value. HostPolicy ("preserve", "target" or "fixed" with Host)
+// decides the Host header sent upstream and takes precedence over the
+// target's own policy.
+type RouteSpec struct {
+	PathPrefix string         `json:"path_prefix,omitempty"`
+	PathRegex  string         `json:"path_regex,omitempty"`
+	Pool       string         `json:"pool,omitempty"`
+	Split      []SplitSpec    `json:"split,omitempty"`
+	Overrides  []OverrideSpec `json:"overrides,omitempty"`
+	Rewrite    *RewriteSpec   `json:"rewrite,omitempty"`
+	Mirror     *MirrorSpec    `json:"mirror,omitempty"`
+	HostPolicy string         `json:"host_policy,omitempty"`
+	Host       string         `json:"host,omitempty"`
+	// WebSocketAuth checks WebSocket upgrades of the route before they are
+	// passed to the pool.
+	WebSocketAuth *AuthSpec `json:"websocket_auth,omitempty"`
+}
+
+// AuthSpec asks an external service whether a request may go ahead. The
+// service gets the client's Authorization and Cookie headers and answers with
+// a 2xx status to allow it. Timeout uses Go duration syntax, default "5s".
+type AuthSpec struct {
+	URL     string `json:"url"`
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// MirrorSpec sends a copy of a share of the route's requests to a shadow pool.
+// Percent defaults to 100.
+type MirrorSpec struct {
+	Pool    string   `json:"pool"`
+	Percent *float64 `json:"percent,omitempty"`
+}
+
+// SplitSpec is the share of a route's traffic sent to a pool, relative to the
+// weights of the other pools of the split.
+type SplitSpec struct {
+	Pool   string `json:"pool"`
+	Weight int    `json:"weight"`
+}
+
+// OverrideSpec sends requests to a pool when the named header, cookie or query
+// parameter has the given value. An empty value matches any value.
+type OverrideSpec struct {
+	Header string `json:"header,omitempty"`
+	Cookie string `json:"cookie,omitempty"`
+	Query  string `json:"query,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Pool   string `json:"pool"`
+}
+
+// RewriteSpec changes the URI sent upstream. The steps run in the order of the
+// fields: strip the prefix, replace the regex (with $1 style capture groups),
+// add the prefix, then remove and add query parameters.
+type RewriteSpec struct {
+	StripPrefix string            `json:"strip_prefix,omitempty"`
+	Regex       string            `json:"regex,omitempty"`
+	Replacement string            `json:"replacement,omitempty"`
+	AddPrefix   string            `json:"add_prefix,omitempty"`
+	RemoveQuery []string          `json:"remove_query,omitempty"`
+	AddQuery    map[string]string `json:"add_query,omitempty"`
+}
+
+// TargetSpec describes a single upstream entry in targets.json. An entry can
+// either be a plain URL string or an object carrying per-target settings.
+type TargetSpec struct {
+	URL            string           `json:"url"`
+	Weight         int              `json:"weight,omitempty"`
+	Tags           []string         `json:"tags,omitempty"`
+	Zone           string           `json:"zone,omitempty"`
+	MaxConnections int              `json:"max_connections,omitempty"`
+	HealthCheck    *HealthCheckSpec `json:"health_check,omitempty"`
+	TLS            *TLSSpec         `json:"tls,omitempty"`
+	Backup         bool             `json:"backup,omitempty"`
+	HostPolicy     string           `json:"host_policy,omitempty"`
+	Host           string           `json:"host,omitempty"`
+}
+
+// HealthCheckSpec overrides the global health check settings for one target.
+// Durations use Go duration syntax ("5s"), empty fields keep the global value.
+type HealthCheckSpec struct {
+	Path               string `json:"path,omitempty"`
+	Interval           string `json:"interval,omitempty"`
+	Timeout            string `json:"timeout,omitempty"`
+	ExpectedStatus     string `json:"expected_status,omitempty"`
+	HealthyThreshold   int    `json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int    `json:"unhealthy_threshold,omitempty"`
+}
+
+// TLSSpec holds the TLS settings used when connecting to an https target.
+type TLSSpec struct {
+	// InsecureSkipVerify defaults to true to match the proxy's behaviour
+	// before per-target TLS settings existed.
+	InsecureSkipVerify *bool  `json:"insecure_skip_verify,omitempty"`
+	ServerName         string `json:"server_name,omitempty"`
+	CAFile             string `json:"ca_file,omitempty"`
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+}
+
+// UnmarshalJSON accepts both the plain string form ("https://host:port") and
+// the object form ({"url": "https://host:port", "weight": 3}).
+func (t *TargetSpec) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err == nil {
+		*t = TargetSpec{URL: raw}
+		return nil
+	}
+
+	// alias type so decoding the object form does not recurse into this method
+	type targetSpec TargetSpec
+	var spec targetSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return err
+	}
+	*t = TargetSpec(spec)
+	return nil
 }
 
 var Targets Target
 
+// TargetsFile is the file the proxy targets are read from.
+const TargetsFile = "targets.json"
+
 func LoadData() {
-	// Open the JSON file
-	file, err := os.Open("targets.json")
+	targets, err := ReadTargets(TargetsFile)
 	if err != nil {
-		fmt.Println("Error opening targets JSON file:", err)
+		fmt.Println("Error loading targets JSON file:", err)
 		panic("No targets to proxy too")
 	}
-	defer file.Close() // Defer closing the file until the function returns
+	Targets = targets
+}
 
-	// Decode the JSON content into the data structure
+// ReadTargets reads and decodes a targets JSON file without touching the
+// loaded targets, so a changed file can be validated before it is used.
+func ReadTargets(path string) (Target, error) {
+	var targets Target
 
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&Targets)
+	// Open the JSON file
+	file, err := os.Open(path)
 	if err != nil {
-		fmt.Println("Error decoding JSON:", err)
-		panic("Error decoding targets to proxy too from json file")
+		return targets, fmt.Errorf("error opening targets JSON file: %w", err)
 	}
+	defer file.Close() // Defer closing the file until the function returns
 
+	// Decode the JSON content into the data structure
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&targets); err != nil {
+		return targets, fmt.Errorf("error decoding targets JSON file: %w", err)
+	}
+	return targets, nil
 }
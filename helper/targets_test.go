@@ -0,0 +1,53 @@
+package helper
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadTargetsAcceptsStringAndObjectEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.json")
+	data := `{
+		"targets": [
+			"http://plain:8080",
+			{"url": "http://weighted:8080", "weight": 3, "max_connections": 10, "zone": "eu-1", "tags": ["canary"]}
+		],
+		"pools": {"api": {"targets": ["http://api:9000", {"url": "http://api-backup:9000", "backup": true}]}}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	targets, err := ReadTargets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets.Targets) != 2 {
+		t.Fatalf("got %d targets, want 2", len(targets.Targets))
+	}
+	if plain := targets.Targets[0]; plain.URL != "http://plain:8080" || plain.Weight != 0 || plain.MaxConnections != 0 {
+		t.Fatalf("string entry decoded as %+v", plain)
+	}
+	weighted := targets.Targets[1]
+	if weighted.URL != "http://weighted:8080" || weighted.Weight != 3 || weighted.MaxConnections != 10 ||
+		weighted.Zone != "eu-1" || len(weighted.Tags) != 1 || weighted.Tags[0] != "canary" {
+		t.Fatalf("object entry decoded as %+v", weighted)
+	}
+	api := targets.Pools["api"].Targets
+	if len(api) != 2 || api[0].URL != "http://api:9000" || api[1].URL != "http://api-backup:9000" || !api[1].Backup {
+		t.Fatalf("pool targets decoded as %+v", api)
+	}
+}
+
+func TestReadTargetsRejectsInvalidEntries(t *testing.T) {
+	for _, entry := range []string{`42`, `["http://a:80"]`, `{"url": "http://a:80", "weight": "heavy"}`} {
+		path := filepath.Join(t.TempDir(), "targets.json")
+		if err := os.WriteFile(path, []byte(`{"targets": [`+entry+`]}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadTargets(path); err == nil {
+			t.Errorf("entry %s accepted", entry)
+		}
+	}
+}
@@ -82,10 +82,18 @@ func NormalEnviromentFrame() {
 var targetsTemplate = `
 {
   "targets": [
-    "https://localhost:8700",
-    "https://localhost:8701",
+    {
+      "url": "https://localhost:8700",
+      "weight": 3,
+      "zone": "zone-a",
+      "tags": ["large"],
+      "max_connections": 512,
+      "health_check": { "path": "/health", "interval": "5s" },
+      "tls": { "insecure_skip_verify": true }
+    },
+    { "url": "https://localhost:8701", "weight": 2 },
     "https://localhost:8702",
-    "https://localhost:8703"
+    { "url": "https://localhost:8703", "backup": true }
   ]
 }
 `
@@ -98,6 +106,118 @@ BODY_LIMIT=70
 READ_BUFFER_SIZE=40
 
 RATE_LIMIT_PER_SECOND=5000
+#Load balancing strategy: weighted_round_robin, round_robin, least_conn, p2c or hash
+LB_STRATEGY=weighted_round_robin
+#Weight p2c choices by the moving average time each target takes to send
+#response headers
+LB_P2C_EWMA=off
+#Affinity key for the hash strategy: ip, header:<name>, cookie:<name> or path:<segment>
+LB_HASH_KEY=ip
+#Ring points per unit of target weight for the hash strategy; more spread keys
+#more evenly
+LB_HASH_REPLICAS=160
+
+#Cookie based sticky sessions
+STICKY_SESSIONS=off
+STICKY_COOKIE_NAME=blue_proxy_affinity
+STICKY_COOKIE_TTL=1h
+STICKY_SIGNING_KEY=
+
+#Active health checks of the targets; the path must start with /
+HEALTH_CHECK=off
+HEALTH_CHECK_PATH=/
+HEALTH_CHECK_INTERVAL=10s
+HEALTH_CHECK_TIMEOUT=2s
+HEALTH_CHECK_EXPECTED_STATUS=200-399
+HEALTH_CHECK_HEALTHY_THRESHOLD=2
+HEALTH_CHECK_UNHEALTHY_THRESHOLD=3
+
+#Passive outlier detection, ejects targets failing real traffic
+OUTLIER_DETECTION=off
+OUTLIER_CONSECUTIVE_FAILURES=5
+OUTLIER_FAILURE_RATE=50
+OUTLIER_MIN_REQUESTS=20
+OUTLIER_INTERVAL=10s
+OUTLIER_BASE_EJECTION_TIME=30s
+OUTLIER_MAX_EJECTION_TIME=5m
+OUTLIER_MIN_SERVING_PERCENT=50
+
+#Per target circuit breaker
+CIRCUIT_BREAKER=off
+CIRCUIT_MAX_REQUESTS=1024
+CIRCUIT_MAX_PENDING=1024
+CIRCUIT_FAILURE_THRESHOLD=5
+CIRCUIT_OPEN_TIMEOUT=30s
+CIRCUIT_HALF_OPEN_REQUESTS=1
+
+#Retries of failed requests on another target
+RETRY_ATTEMPTS=0
+RETRY_PER_TRY_TIMEOUT=0s
+RETRY_BACKOFF_BASE=25ms
+RETRY_BACKOFF_MAX=250ms
+RETRY_ON_STATUS=502,503,504
+RETRY_MAX_BODY_BYTES=1048576
+RETRY_BUDGET_PERCENT=20
+RETRY_MIN_CONCURRENCY=3
+
+#Reload targets.json on change without a restart (SIGHUP always reloads)
+TARGETS_WATCH=on
+TARGETS_WATCH_INTERVAL=2s
+
+#Copies of mirrored requests: sender workers, queue size (full queue drops copies),
+#timeout per copy and largest request body copied
+MIRROR_WORKERS=8
+MIRROR_QUEUE_SIZE=1000
+MIRROR_TIMEOUT=5s
+MIRROR_MAX_BODY_BYTES=1048576
+
+#Flush interval for streamed response bodies (0s leaves it to the server, -1ms
+#flushes every write). Server-sent events and chunked responses always flush at once
+FLUSH_INTERVAL=0s
+
+#Pooled connections to each upstream target: idle connections kept per target,
+#how long they stay idle, and dial, keep-alive, TLS handshake and response header
+#timeouts (0s waits for the response headers as long as the request allows)
+UPSTREAM_MAX_IDLE_CONNS_PER_HOST=64
+UPSTREAM_IDLE_CONN_TIMEOUT=90s
+UPSTREAM_DIAL_TIMEOUT=5s
+UPSTREAM_KEEP_ALIVE=30s
+UPSTREAM_TLS_HANDSHAKE_TIMEOUT=10s
+UPSTREAM_RESPONSE_HEADER_TIMEOUT=0s
+
+#Comma separated CIDR ranges of proxies in front of blue-proxy whose X-Forwarded-*
+#and Forwarded headers are kept (and used as the client address); empty trusts nobody
+TRUSTED_PROXIES=
+
+#Upstream redirects: "passthrough" hands 3xx responses to the client with Location
+#pointed at the proxy, "follow" follows them inside the proxy
+UPSTREAM_REDIRECTS=passthrough
+#Optional Set-Cookie rewrites as comma separated from=to pairs
+COOKIE_DOMAIN_REWRITE=
+COOKIE_PATH_REWRITE=
+
+#WebSocket relay: keepalive pings to both peers (0s for none) and the time they
+#have to answer, idle timeout without messages (0s for none), write timeout,
+#largest message and largest single frame accepted (0 for no frame limit) and
+#how long shutdown waits for open connections to close
+WS_PING_INTERVAL=30s
+WS_PONG_TIMEOUT=10s
+WS_IDLE_TIMEOUT=10m
+WS_WRITE_TIMEOUT=10s
+WS_MAX_MESSAGE_BYTES=1048576
+WS_MAX_FRAME_BYTES=1048576
+WS_DRAIN_TIMEOUT=10s
+
+#Origins allowed to open WebSockets, comma separated ("https://app.example.com",
+#"*.example.com", "*"); empty allows only the proxy's own host
+WS_ALLOWED_ORIGINS=
+#Concurrent WebSocket connections per client IP (0 for no limit)
+WS_MAX_CONNECTIONS_PER_IP=50
+
+#Raw TCP listeners (tcp_listeners in targets.json): close connections that
+#move no data in either direction for this long (0s for never)
+TCP_IDLE_TIMEOUT=1h
+
 #Interval in minutes
 CLEAR_LOGS_INTERVAL=1
 
@@ -105,7 +225,12 @@ CLEAR_LOGS_INTERVAL=1
 TRACE_EXPORTER=jaeger
 TRACER_HOST=localhost
 TRACER_PORT=14317
+#Port of the Prometheus /metrics endpoint, empty to disable
+METRICS_PORT=9100
 
+#Host header sent upstream: "target" (the target URL's host), "preserve" (the
+#client's Host) or "fixed" (TARGET_HOST_NAME). Also used as the TLS server name
+HOST_HEADER_POLICY=target
 TARGET_HOST_NAME=somedomain.com
 `
 var normalTemplate = `
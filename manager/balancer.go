@@ -0,0 +1,215 @@
+package manager
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const (
+	roundRobinStrategy         = "round_robin"
+	weightedRoundRobinStrategy = "weighted_round_robin"
+	leastConnStrategy          = "least_conn"
+	p2cStrategy                = "p2c"
+)
+
+// Balancer picks the upstream target that should serve the given request.
+// Targets that are not available, such as ones failing their health checks,
+// are skipped; nil is returned when no target is available.
+type Balancer interface {
+	NextTarget(r *http.Request) *middleware.ProxyTarget
+}
+
+// newBalancer builds the balancer for the given strategy name, as configured
+// through LB_STRATEGY.
+func newBalancer(strategy string, targets []*middleware.ProxyTarget) (Balancer, error) {
+	switch strings.ToLower(strategy) {
+	case "", weightedRoundRobinStrategy:
+		return NewWeightedRoundRobinBalancer(targets), nil
+	case roundRobinStrategy:
+		return &RoundRobinBalancer{Targets: targets}, nil
+	case leastConnStrategy:
+		return &LeastConnBalancer{Targets: targets}, nil
+	case p2cStrategy:
+		return &P2CBalancer{
+			Targets: targets,
+			EWMA:    configs.AppConfig.GetOrDefault("LB_P2C_EWMA", "off") == "on",
+		}, nil
+	case hashStrategy:
+		key, err := newHashKeyFunc(configs.AppConfig.GetOrDefault("LB_HASH_KEY", "ip"))
+		if err != nil {
+			return nil, err
+		}
+		replicas, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("LB_HASH_REPLICAS", strconv.Itoa(defaultHashReplicas)))
+		return NewHashBalancer(targets, key, replicas), nil
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy: %s", strategy)
+	}
+}
+
+// balancerStrategy returns the strategy configured for the proxy.
+func balancerStrategy() string {
+	return configs.AppConfig.GetOrDefault("LB_STRATEGY", weightedRoundRobinStrategy)
+}
+
+// targetSpec returns the targets.json entry the target was built from.
+func targetSpec(target *middleware.ProxyTarget) helper.TargetSpec {
+	spec, _ := target.Meta["spec"].(helper.TargetSpec)
+	return spec
+}
+
+// targetWeight returns the configured weight of the target, defaulting to 1.
+func targetWeight(target *middleware.ProxyTarget) int {
+	if weight := targetSpec(target).Weight; weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// RoundRobinBalancer is a simple load balancer
+type RoundRobinBalancer struct {
+	Targets []*middleware.ProxyTarget
+	mu      sync.Mutex
+	index   int
+}
+
+// NextTarget returns the next target in round-robin fashion
+func (r *RoundRobinBalancer) NextTarget(*http.Request) *middleware.ProxyTarget {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for range r.Targets {
+		target := r.Targets[r.index]
+		r.index = (r.index + 1) % len(r.Targets) // Round-robin logic
+		if isAvailable(target) {
+			return target
+		}
+	}
+	return nil
+}
+
+// WeightedRoundRobinBalancer implements the smooth weighted round-robin used by
+// nginx: every pick raises each target's current weight by its configured
+// weight, selects the highest one and lowers it by the total weight. Targets
+// with a bigger weight get proportionally more requests while picks stay
+// interleaved instead of arriving in bursts.
+type WeightedRoundRobinBalancer struct {
+	Targets []*middleware.ProxyTarget
+	mu      sync.Mutex
+	current []int
+}
+
+// NewWeightedRoundRobinBalancer creates a smooth weighted round-robin balancer
+// over the given targets.
+func NewWeightedRoundRobinBalancer(targets []*middleware.ProxyTarget) *WeightedRoundRobinBalancer {
+	return &WeightedRoundRobinBalancer{
+		Targets: targets,
+		current: make([]int, len(targets)),
+	}
+}
+
+// NextTarget returns the target with the highest current weight
+func (w *WeightedRoundRobinBalancer) NextTarget(*http.Request) *middleware.ProxyTarget {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	best, total := -1, 0
+	for i, target := range w.Targets {
+		if !isAvailable(target) {
+			continue
+		}
+		weight := targetWeight(target)
+		w.current[i] += weight
+		total += weight
+		if best == -1 || w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+
+	w.current[best] -= total
+	return w.Targets[best]
+}
+
+// LeastConnBalancer sends each request to the target with the fewest
+// outstanding requests relative to its weight.
+type LeastConnBalancer struct {
+	Targets []*middleware.ProxyTarget
+	mu      sync.Mutex
+	index   int
+}
+
+// NextTarget returns the least loaded target, rotating the starting point so
+// equally loaded targets share the traffic
+func (l *LeastConnBalancer) NextTarget(*http.Request) *middleware.ProxyTarget {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.Targets) == 0 {
+		return nil
+	}
+
+	var best *middleware.ProxyTarget
+	bestLoad := 0.0
+	for i := range l.Targets {
+		target := l.Targets[(l.index+i)%len(l.Targets)]
+		if !isAvailable(target) {
+			continue
+		}
+		load := float64(stateOf(target).Inflight()) / float64(targetWeight(target))
+		if best == nil || load < bestLoad {
+			best, bestLoad = target, load
+		}
+	}
+	l.index = (l.index + 1) % len(l.Targets)
+	return best
+}
+
+// P2CBalancer implements "power of two choices": it samples two random targets
+// and keeps the one with fewer outstanding requests. With EWMA enabled the
+// outstanding count is weighted by the target's moving average latency, so a
+// slow target needs fewer requests in flight to be considered busy.
+type P2CBalancer struct {
+	Targets []*middleware.ProxyTarget
+	EWMA    bool
+}
+
+// NextTarget returns the less loaded of two randomly chosen targets
+func (p *P2CBalancer) NextTarget(*http.Request) *middleware.ProxyTarget {
+	targets := availableTargets(p.Targets)
+	switch len(targets) {
+	case 0:
+		return nil
+	case 1:
+		return targets[0]
+	}
+
+	i := rand.Intn(len(targets))
+	j := rand.Intn(len(targets) - 1)
+	if j >= i {
+		j++
+	}
+
+	first, second := targets[i], targets[j]
+	if p.load(second) < p.load(first) {
+		return second
+	}
+	return first
+}
+
+func (p *P2CBalancer) load(target *middleware.ProxyTarget) float64 {
+	state := stateOf(target)
+	load := float64(state.Inflight())
+	if p.EWMA {
+		// +1 so idle targets are still ranked by their latency
+		load = (load + 1) * state.Latency()
+	}
+	return load / float64(targetWeight(target))
+}
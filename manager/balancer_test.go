@@ -0,0 +1,99 @@
+package manager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// testTargets builds targets from specs and forgets their runtime state once
+// the test is over.
+func testTargets(t *testing.T, specs ...helper.TargetSpec) []*middleware.ProxyTarget {
+	t.Helper()
+	targets, err := buildTargets(specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, target := range targets {
+			upstreamStates.Delete(target.URL.String())
+		}
+	})
+	return targets
+}
+
+func TestLeastConnPicksLeastLoadedByWeight(t *testing.T) {
+	targets := testTargets(t,
+		helper.TargetSpec{URL: "http://lc-a:80"},
+		helper.TargetSpec{URL: "http://lc-b:80", Weight: 4},
+		helper.TargetSpec{URL: "http://lc-c:80"},
+	)
+	stateOf(targets[0]).inflight.Store(2)
+	stateOf(targets[1]).inflight.Store(4) // 1 per unit of weight
+	stateOf(targets[2]).inflight.Store(3)
+	balancer := &LeastConnBalancer{Targets: targets}
+
+	for range 3 {
+		if got := balancer.NextTarget(nil); got != targets[1] {
+			t.Fatalf("picked %s, want the least loaded per weight %s", got.URL, targets[1].URL)
+		}
+	}
+
+	stateOf(targets[1]).healthy.Store(false)
+	if got := balancer.NextTarget(nil); got != targets[0] {
+		t.Fatalf("picked %s with the best target unhealthy, want %s", got.URL, targets[0].URL)
+	}
+}
+
+func TestP2CPicksFewerInflight(t *testing.T) {
+	targets := testTargets(t, helper.TargetSpec{URL: "http://p2c-a:80"}, helper.TargetSpec{URL: "http://p2c-b:80"})
+	stateOf(targets[0]).inflight.Store(5)
+	balancer := &P2CBalancer{Targets: targets}
+
+	// With two targets both are always sampled
+	for range 20 {
+		if got := balancer.NextTarget(nil); got != targets[1] {
+			t.Fatalf("picked %s, want the idle %s", got.URL, targets[1].URL)
+		}
+	}
+}
+
+func TestP2CWithEWMAPicksFasterTarget(t *testing.T) {
+	targets := testTargets(t, helper.TargetSpec{URL: "http://ewma-a:80"}, helper.TargetSpec{URL: "http://ewma-b:80"})
+	stateOf(targets[0]).observeLatency(200 * time.Millisecond)
+	stateOf(targets[1]).observeLatency(10 * time.Millisecond)
+	// The fast target stays ahead with a couple of requests in flight
+	stateOf(targets[1]).inflight.Store(2)
+	balancer := &P2CBalancer{Targets: targets, EWMA: true}
+
+	for range 20 {
+		if got := balancer.NextTarget(nil); got != targets[1] {
+			t.Fatalf("picked %s, want the faster %s", got.URL, targets[1].URL)
+		}
+	}
+}
+
+func TestLatencyIsTimeToResponseHeaders(t *testing.T) {
+	// Headers right away, then a body that takes a while to stream
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+	targets := testTargets(t, helper.TargetSpec{URL: backend.URL})
+
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+	if err := forwardRequestToTarget(c, targets[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	if latency := stateOf(targets[0]).Latency(); latency <= 0 || latency >= 0.15 {
+		t.Fatalf("latency %.3fs, want the time to headers, not the body", latency)
+	}
+}
@@ -0,0 +1,232 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// circuitHeader tells clients why the proxy answered 503 without calling the
+// upstream target.
+const circuitHeader = "X-Blue-Proxy-Circuit"
+
+var (
+	errCircuitOpen     = errors.New("circuit breaker is open")
+	errCircuitOverflow = errors.New("circuit breaker pending queue is full")
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+// callResult is the outcome of a call reported back to a circuit breaker.
+type callResult int
+
+const (
+	callFailed callResult = iota
+	callSucceeded
+	// callAbandoned is a call the client gave up on, which says nothing about
+	// the target and is not recorded
+	callAbandoned
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreakerConfig holds the limits shared by the breakers of all targets.
+type CircuitBreakerConfig struct {
+	MaxRequests      int // concurrent requests to a target, 0 for unlimited
+	MaxPending       int // requests waiting for a free slot
+	FailureThreshold int // consecutive failures that open the breaker
+	OpenTimeout      time.Duration
+	HalfOpenRequests int // trial requests let through while half-open
+}
+
+// breakerConfig is the circuit breaker configuration of the proxy, nil when
+// CIRCUIT_BREAKER is turned off.
+var breakerConfig *CircuitBreakerConfig
+
+// breakers holds the circuit breaker of every target keyed by its URL.
+var breakers sync.Map
+
+// newCircuitBreakerConfig reads the circuit breaker settings, returning nil
+// when CIRCUIT_BREAKER is not turned on.
+func newCircuitBreakerConfig() (*CircuitBreakerConfig, error) {
+	if configs.AppConfig.GetOrDefault("CIRCUIT_BREAKER", "off") != "on" {
+		return nil, nil
+	}
+
+	openTimeout, err := time.ParseDuration(configs.AppConfig.GetOrDefault("CIRCUIT_OPEN_TIMEOUT", "30s"))
+	if err != nil || openTimeout <= 0 {
+		return nil, fmt.Errorf("invalid CIRCUIT_OPEN_TIMEOUT: %q", configs.AppConfig.Get("CIRCUIT_OPEN_TIMEOUT"))
+	}
+	maxRequests, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("CIRCUIT_MAX_REQUESTS", "1024"))
+	maxPending, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("CIRCUIT_MAX_PENDING", "1024"))
+	threshold, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("CIRCUIT_FAILURE_THRESHOLD", "5"))
+	halfOpen, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("CIRCUIT_HALF_OPEN_REQUESTS", "1"))
+
+	return &CircuitBreakerConfig{
+		MaxRequests:      max(maxRequests, 0),
+		MaxPending:       max(maxPending, 0),
+		FailureThreshold: max(threshold, 1),
+		OpenTimeout:      openTimeout,
+		HalfOpenRequests: max(halfOpen, 1),
+	}, nil
+}
+
+// CircuitBreaker guards the calls to one target. While closed it limits the
+// number of concurrent and queued requests; after FailureThreshold failures in
+// a row it opens and rejects every request until OpenTimeout has passed. It
+// then lets a few trial requests through (half-open) and closes again once
+// they succeed, or reopens on the first failure.
+type CircuitBreaker struct {
+	Name   string
+	Config *CircuitBreakerConfig
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	trials   int // trial requests in flight while half-open
+	pending  int
+	slots    chan struct{}
+}
+
+// NewCircuitBreaker creates a closed circuit breaker.
+func NewCircuitBreaker(name string, config *CircuitBreakerConfig) *CircuitBreaker {
+	breaker := &CircuitBreaker{Name: name, Config: config}
+	if config.MaxRequests > 0 {
+		breaker.slots = make(chan struct{}, config.MaxRequests)
+	}
+	return breaker
+}
+
+// breakerOf returns the circuit breaker of the target, nil when circuit
+// breaking is turned off.
+func breakerOf(target *middleware.ProxyTarget) *CircuitBreaker {
+	if breakerConfig == nil {
+		return nil
+	}
+	key := target.URL.String()
+	if breaker, ok := breakers.Load(key); ok {
+		return breaker.(*CircuitBreaker)
+	}
+	breaker, _ := breakers.LoadOrStore(key, NewCircuitBreaker(key, breakerConfig))
+	return breaker.(*CircuitBreaker)
+}
+
+// Acquire asks the breaker for permission to call the target. On success the
+// returned function must be called with the outcome of the call.
+func (b *CircuitBreaker) Acquire(ctx context.Context) (func(result callResult), error) {
+	b.mu.Lock()
+	if b.state == circuitOpen && time.Since(b.openedAt) >= b.Config.OpenTimeout {
+		b.setState(circuitHalfOpen)
+	}
+	switch b.state {
+	case circuitOpen:
+		b.mu.Unlock()
+		return nil, errCircuitOpen
+	case circuitHalfOpen:
+		if b.trials >= b.Config.HalfOpenRequests {
+			b.mu.Unlock()
+			return nil, errCircuitOpen
+		}
+		b.trials++
+	}
+	trial := b.state == circuitHalfOpen
+
+	if b.slots != nil {
+		select {
+		case b.slots <- struct{}{}:
+		default:
+			if b.pending >= b.Config.MaxPending {
+				b.release(trial)
+				b.mu.Unlock()
+				return nil, errCircuitOverflow
+			}
+			b.pending++
+			b.mu.Unlock()
+
+			select {
+			case b.slots <- struct{}{}:
+			case <-ctx.Done():
+				b.mu.Lock()
+				b.pending--
+				b.release(trial)
+				b.mu.Unlock()
+				return nil, ctx.Err()
+			}
+
+			b.mu.Lock()
+			b.pending--
+		}
+	}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return func(result callResult) {
+		once.Do(func() {
+			if b.slots != nil {
+				<-b.slots
+			}
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.release(trial)
+			if result != callAbandoned {
+				b.record(result == callSucceeded)
+			}
+		})
+	}, nil
+}
+
+// release gives back a half-open trial slot. Callers hold b.mu.
+func (b *CircuitBreaker) release(trial bool) {
+	if trial && b.trials > 0 {
+		b.trials--
+	}
+}
+
+// record applies the outcome of a call to the breaker state. Callers hold b.mu.
+func (b *CircuitBreaker) record(success bool) {
+	if success {
+		b.failures = 0
+		if b.state == circuitHalfOpen {
+			b.setState(circuitClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || (b.state == circuitClosed && b.failures >= b.Config.FailureThreshold) {
+		b.openedAt = time.Now()
+		b.setState(circuitOpen)
+	}
+}
+
+// setState moves the breaker to a new state. Callers hold b.mu.
+func (b *CircuitBreaker) setState(state circuitState) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	circuitStateGauge.WithLabelValues(b.Name).Set(float64(state))
+	fmt.Printf("INFO: circuit breaker of upstream target %s is %s\n", b.Name, state)
+}
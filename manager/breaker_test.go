@@ -0,0 +1,63 @@
+package manager
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/labstack/echo/v4"
+)
+
+func TestCircuitBreakerIgnoresAbandonedCalls(t *testing.T) {
+	breaker := NewCircuitBreaker("test", &CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute, HalfOpenRequests: 1})
+
+	release, err := breaker.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release(callAbandoned)
+	if breaker.state != circuitClosed {
+		t.Fatalf("abandoned call moved the breaker to %s", breaker.state)
+	}
+
+	release, err = breaker.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release(callFailed)
+	if breaker.state != circuitOpen {
+		t.Fatalf("failed call left the breaker %s, want open", breaker.state)
+	}
+}
+
+func TestClientDisconnectIsNotATargetFailure(t *testing.T) {
+	previous := breakerConfig
+	breakerConfig = &CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute, HalfOpenRequests: 1}
+	t.Cleanup(func() { breakerConfig = previous })
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	targets, err := buildTargets([]helper.TargetSpec{{URL: slow.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { breakers.Delete(targets[0].URL.String()) })
+
+	// The client gives up while the target is still working on the request
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	if err := forwardRequestToTarget(c, targets[0], nil); err == nil {
+		t.Fatal("cancelled request succeeded")
+	}
+
+	if state := breakerOf(targets[0]).state; state != circuitClosed {
+		t.Fatalf("client disconnect moved the breaker to %s", state)
+	}
+}
@@ -1,18 +1,18 @@
 package manager
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"math/rand"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"net/http/httptrace"
@@ -21,7 +21,6 @@ import (
 	"github.com/bushubdegefu/blue-proxy/helper"
 	"github.com/bushubdegefu/blue-proxy/logger"
 	"github.com/bushubdegefu/blue-proxy/observe"
-	"github.com/gorilla/websocket" // Needed for WebSocket support
 	"github.com/labstack/echo-contrib/echoprometheus"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -31,6 +30,7 @@ import (
 	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 )
@@ -94,7 +94,13 @@ func echo_run(env string) {
 		Format: `{"time":"${time_rfc3339_nano}","id":"${id}","remote_ip":"${remote_ip}",` +
 			`"host":"${host}","method":"${method}","uri":"${uri}","user_agent":"${user_agent}",` +
 			`"status":${status},"error":"${error}","latency":${latency},"latency_human":"${latency_human}"` +
-			`,"bytes_in":${bytes_in},"bytes_out":${bytes_out}}` + "\n",
+			`,"bytes_in":${bytes_in},"bytes_out":${bytes_out},"upstream_uri":"${custom}"}` + "\n",
+		// ${custom} logs the URI sent upstream, which differs from "uri" when the
+		// route rewrote it
+		CustomTagFunc: func(c echo.Context, buf *bytes.Buffer) (int, error) {
+			quoted, _ := json.Marshal(upstreamURI(c))
+			return buf.Write(quoted[1 : len(quoted)-1])
+		},
 		Output: logOutput,
 	}))
 
@@ -122,124 +128,159 @@ func echo_run(env string) {
 		app.Use(otelechospanstarter)
 	}
 
-	// Setup Proxy targets
-	targets, err := getting_URL()
+	// Host header sent to targets without a route or target level policy
+	hostPolicy, err := newDefaultHostPolicy()
+	if err != nil {
+		panic(err)
+	}
+	defaultHostPolicy = hostPolicy
+
+	// Upstream redirects and the rewrite of headers naming the upstream
+	redirectPolicy, err = newRedirectPolicy()
 	if err != nil {
 		panic(err)
 	}
 
-	// Load balancing setup
-	loadBalancer := &RoundRobinBalancer{
-		Targets: targets,
+	// Which proxies in front of us may set the client address headers
+	if err := setupTrustedProxies(app); err != nil {
+		panic(err)
+	}
+
+	// Setup Proxy targets, pools and routes
+	routes, err := NewRouteTable(helper.Targets)
+	if err != nil {
+		panic(err)
+	}
+
+	// Cookie based session affinity, nil when turned off
+	sticky, err := newStickySessions()
+	if err != nil {
+		panic(err)
 	}
 
 	// Setup the proxy handler for each request
 	app.Any("/*", func(c echo.Context) error {
+		// Find the upstream pool serving the request
+		route := routes.Match(c.Request())
+		if route == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "no route for request")
+		}
+		pool := route.Select(c.Request())
+		if route.Rewrite != nil {
+			c.Set(upstreamURIKey, route.Rewrite.Apply(c.Request().URL))
+		}
+		if route.HostPolicy != nil {
+			c.Set(hostPolicyKey, route.HostPolicy)
+		}
+
 		// Use the load balancer to get the next target to forward the request to
-		target := loadBalancer.NextTarget()
+		// and hold one of its slots until the request is done
+		loadBalancer := pool.Balancer()
+		var target *middleware.ProxyTarget
+		var release func()
+		if sticky != nil {
+			target, release = sticky.NextTarget(c, pool)
+		} else {
+			target, release = pickTarget(loadBalancer, c.Request())
+		}
+		if target == nil {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "no healthy upstream target")
+		}
+		defer release()
 
 		// Check if it's a WebSocket request and upgrade if necessary
 		if isWebSocketUpgrade(c.Request()) {
-			return handleWebSocketUpgrade(c, target.URL)
+			admitted, err := admitWebSocket(c, route)
+			if err != nil {
+				return err
+			}
+			defer admitted()
+			return handleWebSocketUpgrade(c, target)
 		}
 
-		// Handle static files and other normal requests
-		return forwardRequestToTarget(c, target.URL)
-	})
-
-	// getting log clearing task
-	log_truncate := logger.ScheduledTasks()
-
-	// Start the server
-	go startServer(app)
-
-	// Graceful shutdown
-	waitForShutdown(app, log_truncate)
-}
+		// Copy the request to the route's shadow pool without waiting on it
+		if route.Mirror != nil {
+			mirrorRequest(c, route.Mirror)
+		}
 
-func isWebSocketUpgrade(req *http.Request) bool {
-	return req.Header.Get("Upgrade") == "websocket" && req.Header.Get("Connection") == "Upgrade"
-}
+		// Handle static files and other normal requests, retrying on other
+		// targets when the retry policy allows it
+		return proxyWithRetries(c, target, release, loadBalancer)
+	})
 
-func handleWebSocketUpgrade(c echo.Context, targetURL *url.URL) error {
-	// Upgrade the incoming HTTP request to a WebSocket
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true // Allow all origins (you can adjust this for security)
-		},
-	}
-	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	// Liveness checks and limits of relayed WebSocket connections
+	wsConfig, err = newWebSocketConfig()
 	if err != nil {
-		return fmt.Errorf("failed to upgrade to WebSocket: %w", err)
+		panic(err)
 	}
-	defer conn.Close()
 
-	// Create a new WebSocket request to the target server
-	req, err := http.NewRequest(c.Request().Method, targetURL.String()+c.Request().RequestURI, c.Request().Body)
+	// Workers sending the copies of mirrored requests
+	mirrorQueue, err = newMirrorQueue()
 	if err != nil {
-		return fmt.Errorf("failed to create WebSocket request: %w", err)
+		panic(err)
 	}
+	mirrorQueue.Start()
+	defer mirrorQueue.Stop()
 
-	// Copy headers from the incoming request to the new request
-	for key, values := range c.Request().Header {
-		for _, value := range values {
-			req.Header.Add(key, value)
-		}
+	// Active health checks of the upstream targets
+	healthConfig, err := newHealthCheckConfig()
+	if err != nil {
+		panic(err)
+	}
+	if healthConfig != nil {
+		checker := NewHealthChecker(healthConfig, routes.Targets)
+		checker.Start()
+		defer checker.Stop()
 	}
 
-	// Create an HTTP client for WebSocket handling
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				ServerName:         targetURL.Hostname(),
-				InsecureSkipVerify: true,
-			},
-		},
+	// Per target circuit breakers around the upstream calls
+	breakerConfig, err = newCircuitBreakerConfig()
+	if err != nil {
+		panic(err)
 	}
 
-	// Send the request to the target server (this is a WebSocket upgrade request)
-	resp, err := client.Do(req)
+	// Retries of failed upstream calls on other targets
+	retryPolicy, err = newRetryPolicy()
 	if err != nil {
-		return fmt.Errorf("failed to send WebSocket request: %w", err)
+		panic(err)
 	}
-	defer resp.Body.Close()
 
-	// Establish WebSocket connection with the target server
-	targetConn, _, err := websocket.DefaultDialer.Dial(resp.Request.URL.String(), nil)
+	// Passive outlier detection on the outcome of proxied requests
+	outlierDetector, err = newOutlierDetector(routes.Pools)
 	if err != nil {
-		return fmt.Errorf("failed to establish WebSocket connection to target: %w", err)
+		panic(err)
 	}
-	defer targetConn.Close()
 
-	// Forward messages between the client WebSocket and target WebSocket
-	go forwardWebSocketMessages(conn, targetConn)
-	return nil
-}
+	// Reload targets.json on SIGHUP, and on change unless TARGETS_WATCH is off,
+	// without a restart
+	watcher := NewTargetsWatcher(helper.TargetsFile, routes)
+	watcher.Start()
+	defer watcher.Stop()
 
-func forwardWebSocketMessages(clientConn, targetConn *websocket.Conn) {
-	// Forward messages from client to target and vice versa
-	for {
-		msgType, msg, err := clientConn.ReadMessage()
-		if err != nil {
-			break
-		}
-		err = targetConn.WriteMessage(msgType, msg)
-		if err != nil {
-			break
+	// Prometheus metrics on their own port when METRICS_PORT is set
+	startMetricsServer()
+
+	// Raw TCP listeners of targets.json, balanced over their pools
+	for _, tcpRoute := range routes.Router().TCPRoutes {
+		listener := NewTCPListener(tcpRoute, routes)
+		if err := listener.Start(); err != nil {
+			panic(err)
 		}
+		defer listener.Stop()
 	}
-}
 
-// CreateHTTPClientWithOTELAndTLS creates an HTTP client with both OpenTelemetry tracing and TLS configuration.
-func createHTTPClientWithOTELAndTLS(targetURL *url.URL, ctx context.Context) *http.Client {
-	// Create the base HTTP transport with TLS support
-	baseTransport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			ServerName:         targetURL.Hostname(),
-			InsecureSkipVerify: true, // Set to false in production for security
-		},
-	}
+	// getting log clearing task
+	log_truncate := logger.ScheduledTasks()
+
+	// Start the server
+	go startServer(app)
+
+	// Graceful shutdown
+	waitForShutdown(app, log_truncate)
+}
 
+// createHTTPClientWithOTEL creates an HTTP client adding OpenTelemetry tracing to the target's transport.
+func createHTTPClientWithOTEL(baseTransport http.RoundTripper, ctx context.Context) *http.Client {
 	// Create a client transport that adds OTEL instrumentation
 	otelTransport := otelhttp.NewTransport(
 		baseTransport,
@@ -250,112 +291,159 @@ func createHTTPClientWithOTELAndTLS(targetURL *url.URL, ctx context.Context) *ht
 		}),
 	)
 
-	// Return the HTTP client with both OTEL and TLS functionality
+	// Return the HTTP client with OTEL over the shared transport
 	return &http.Client{
 		Transport: otelTransport,
-		// Optional: Add redirect logic (to prevent too many redirects)
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			if len(via) >= 10 {
-				return fmt.Errorf("too many redirects")
-			}
-			// Log or handle redirect logic here if needed
-			fmt.Println("Redirected to:", req.URL)
-			return nil // Follow the redirect
-		},
+		// Pass redirects through or follow them, see UPSTREAM_REDIRECTS
+		CheckRedirect: redirectPolicy.checkRedirect,
 	}
 }
 
-func forwardRequestToTarget(c echo.Context, targetURL *url.URL) error {
+func forwardRequestToTarget(c echo.Context, target *middleware.ProxyTarget, attempt *upstreamAttempt) error {
+	targetURL := target.URL
 
-	target_url := fmt.Sprintf("%v%v", targetURL.String(), c.Request().RequestURI)
-	req, err := http.NewRequest(c.Request().Method, target_url, c.Request().Body)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-
-	// Copy headers from the incoming request to the new request
-	for key, values := range c.Request().Header {
-		for _, value := range values {
-			req.Header.Add(key, value)
-		}
-	}
+	// Cancelled with the client's request, or by the per try timeout
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
 
-	// Create an HTTP client
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				ServerName:         targetURL.Hostname(),
-				InsecureSkipVerify: true,
-			},
-		},
-		// Allow following redirects
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			// Optionally, limit the number of redirects
-			if len(via) >= 10 {
-				return fmt.Errorf("too many redirects")
-			}
-			// Print the redirect URL to debug
-			fmt.Println("Redirected to:", req.URL)
-			return nil // Follow the redirect
-		},
-	}
+	// Record whether the request made it to the target, retrying is only safe
+	// for non idempotent requests that were never written
+	var sent atomic.Bool
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) { sent.Store(true) },
+	})
 
-	// Ensure OpenTelemetry tracing is enabled if otel is on on the client
+	// Continue the client's trace: the W3C trace context and baggage it sent
+	// are carried over, under the proxy's own span when OTEL is on
+	ctx = tracePropagator.Extract(ctx, propagation.HeaderCarrier(c.Request().Header))
 	if proxy_otel == "on" {
 		// Get the tracer from the context
 		tracer := c.Get("tracer").(*observe.RouteTracer)
-		ctx := tracer.Tracer
 
 		// Start a new span for the outgoing request
-		_, span := observe.AppTracer.Start(ctx, fmt.Sprintf("started-proxy-span-%v", rand.Intn(1000)))
+		_, span := observe.AppTracer.Start(tracer.Tracer, fmt.Sprintf("started-proxy-span-%v", rand.Intn(1000)))
 		defer span.End() // Ensure the span ends when the function finishes
 
-		// Inject the span context into the outgoing request context
+		// Describe the upstream target on the span
+		spec := targetSpec(target)
+		span.SetAttributes(
+			attribute.String("upstream.url", targetURL.String()),
+			attribute.String("upstream.zone", spec.Zone),
+			attribute.StringSlice("upstream.tags", spec.Tags),
+			attribute.Bool("upstream.backup", spec.Backup),
+			attribute.String("http.original_uri", c.Request().RequestURI),
+			attribute.String("http.upstream_uri", upstreamURI(c)),
+		)
+
+		// Make the span the parent of the upstream call, keeping the client's
+		// cancellation and deadlines
 		ctx = trace.ContextWithSpan(ctx, span)
-
-		// Create the HTTP client with OTEL and TLS configuration
-		client = createHTTPClientWithOTELAndTLS(targetURL, ctx)
 	}
 
-	// Send the request to the target server
-	resp, err := client.Do(req)
+	body, contentLength := attempt.requestBody(c)
+	target_url := fmt.Sprintf("%v%v", targetURL.String(), upstreamURI(c))
+	req, err := http.NewRequestWithContext(ctx, c.Request().Method, target_url, body)
 	if err != nil {
-		return fmt.Errorf("failed to send request to target: %w", err)
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = contentLength
+
+	// Copy the end-to-end headers from the incoming request and tell the
+	// target who the client is
+	copyRequestHeaders(req.Header, c.Request())
+	req.Host = hostPolicyOf(c, target).host(c.Request().Host, target)
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	// Create an HTTP client over the target's shared, pooled transport
+	transport := transportForHost(target, req.Host)
+	client := &http.Client{
+		Transport: transport,
+		// Pass redirects through or follow them, see UPSTREAM_REDIRECTS
+		CheckRedirect: redirectPolicy.checkRedirect,
+	}
+	if proxy_otel == "on" {
+		// Create the HTTP client with OTEL over the target's transport
+		client = createHTTPClientWithOTEL(transport, ctx)
 	}
-	defer resp.Body.Close()
 
-	// Copy the response headers and status code
-	for key, values := range resp.Header {
-		for _, value := range values {
-			c.Response().Header().Add(key, value)
+	// Ask the target's circuit breaker before calling it
+	result := callFailed
+	if breaker := breakerOf(target); breaker != nil {
+		release, err := breaker.Acquire(c.Request().Context())
+		if err != nil {
+			if attempt != nil && attempt.retry != nil && attempt.retry(nil, err, false) {
+				return nil
+			}
+			if errors.Is(err, errCircuitOverflow) {
+				c.Response().Header().Set(circuitHeader, "overflow")
+			} else {
+				c.Response().Header().Set(circuitHeader, "open")
+			}
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "upstream target unavailable: "+err.Error())
 		}
+		defer func() { release(result) }()
 	}
 
-	c.Response().WriteHeader(resp.StatusCode)
+	// Bound the time the target has to answer with response headers, counted
+	// from when the breaker let the call through
+	var timer *time.Timer
+	if attempt != nil && retryPolicy != nil && retryPolicy.PerTryTimeout > 0 {
+		timer = time.AfterFunc(retryPolicy.PerTryTimeout, cancel)
+	}
 
-	// Read the response body into a byte slice
-	body, err := io.ReadAll(resp.Body)
+	// Send the request to the target server, timing it up to the response
+	// headers for the latency aware balancers
+	start := time.Now()
+	resp, err := client.Do(req)
+	if timer != nil && !timer.Stop() && err == nil {
+		// The headers raced the per try timeout, the body is already cancelled
+		resp.Body.Close()
+		err = context.DeadlineExceeded
+	}
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
+		if c.Request().Context().Err() != nil {
+			// The client went away, which says nothing about the target
+			result = callAbandoned
+		} else {
+			reportResult(target, false)
+		}
+		if attempt != nil && attempt.retry != nil && attempt.retry(nil, err, sent.Load()) {
+			return nil
+		}
+		return fmt.Errorf("failed to send request to target: %w", err)
 	}
+	defer resp.Body.Close()
+	stateOf(target).observeLatency(time.Since(start))
+	success := resp.StatusCode < http.StatusInternalServerError
+	if success {
+		result = callSucceeded
+	}
+	reportResult(target, success)
 
-	// Copy the response body to the client
-	_, err = c.Response().Write(body)
-	if err != nil {
-		return fmt.Errorf("failed to write response body: %w", err)
+	// Drop this response when the status is worth another try
+	if attempt != nil && attempt.retry != nil && attempt.retry(resp, nil, true) {
+		return nil
 	}
 
-	return nil
+	// Point headers naming the upstream at the proxy, then stream the
+	// response headers, body and trailers to the client
+	redirectPolicy.rewriteResponse(c, target, req.Host, resp)
+	return copyResponse(c, resp)
 }
 
 func startServer(app *echo.Echo) {
 	HTTP_PORT := configs.AppConfig.Get("HTTP_PORT")
+	var err error
 	if proxy_tls == "on" {
 		CERT_FILE := "./server.pem"
 		KEY_FILE := "./server-key.pem"
-		app.Logger.Fatal(app.StartTLS("0.0.0.0:"+HTTP_PORT, CERT_FILE, KEY_FILE))
+		err = app.StartTLS("0.0.0.0:"+HTTP_PORT, CERT_FILE, KEY_FILE)
 	} else {
-		app.Logger.Fatal(app.Start("0.0.0.0:" + HTTP_PORT))
+		err = app.Start("0.0.0.0:" + HTTP_PORT)
+	}
+	// Shutdown makes Start return ErrServerClosed, leave the exit to waitForShutdown
+	if !errors.Is(err, http.ErrServerClosed) {
+		app.Logger.Fatal(err)
 	}
 }
 
@@ -374,11 +462,20 @@ func waitForShutdown(app *echo.Echo, log_truncate *tasks.Scheduler) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel() // Ensure the cancel function is called when the context is no longer needed.
 
+	// WebSocket connections are hijacked and not waited on by Shutdown, so
+	// close them with 1001 (Going Away) while the HTTP requests finish.
+	wsDrained := make(chan struct{})
+	go func() {
+		wsSessions.drain(wsConfig.DrainTimeout)
+		close(wsDrained)
+	}()
+
 	// Attempt to gracefully shut down the Echo server.
 	// If an error occurs during the shutdown process, log the fatal error.
 	if err := app.Shutdown(ctx); err != nil {
 		app.Logger.Fatal(err)
 	}
+	<-wsDrained
 
 	// Truncate the log file after shutdown.
 	log_truncate.Stop()
@@ -387,38 +484,6 @@ func waitForShutdown(app *echo.Echo, log_truncate *tasks.Scheduler) {
 	fmt.Println("Gracefully shutting down...")
 }
 
-func getting_URL() ([]*middleware.ProxyTarget, error) {
-	helper.LoadData()
-	var urls []*middleware.ProxyTarget
-	for _, value := range helper.Targets.Targets {
-		url, err := url.Parse(value)
-		if err != nil {
-			return nil, err
-		}
-		if url.Scheme != "http" && url.Scheme != "https" {
-			return nil, fmt.Errorf("invalid target URL scheme: %s", url.Scheme)
-		}
-		urls = append(urls, &middleware.ProxyTarget{URL: url})
-	}
-	return urls, nil
-}
-
-// RoundRobinBalancer is a simple load balancer
-type RoundRobinBalancer struct {
-	Targets []*middleware.ProxyTarget
-	mu      sync.Mutex
-	index   int
-}
-
-// NextTarget returns the next target in round-robin fashion
-func (r *RoundRobinBalancer) NextTarget() *middleware.ProxyTarget {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	target := r.Targets[r.index]
-	r.index = (r.index + 1) % len(r.Targets) // Round-robin logic
-	return target
-}
-
 func init() {
 	devechocli.Flags().StringVar(&env, "env", "help", "Which environment to run for example prod or dev")
 	devechocli.Flags().StringVar(&proxy_otel, "otel", "help", "Turn on/off OpenTelemetry tracing")
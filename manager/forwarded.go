@@ -0,0 +1,233 @@
+package manager
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// hopHeaders are the hop-by-hop headers of RFC 9110 section 7.6.1, meant for a
+// single connection and never forwarded by a proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard but still sent by some clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers, including the ones the
+// Connection header names, from h.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// copyRequestHeaders copies the client request's end-to-end headers to the
+// upstream request header h and adds the forwarding headers.
+func copyRequestHeaders(h http.Header, req *http.Request) {
+	for key, values := range req.Header {
+		for _, value := range values {
+			h.Add(key, value)
+		}
+	}
+	removeHopHeaders(h)
+	// "TE: trailers" is how gRPC clients say they understand trailers, which
+	// the upstream needs to know; it is the only TE value worth passing on
+	for _, value := range req.Header.Values("Te") {
+		if strings.Contains(strings.ToLower(value), "trailers") {
+			h.Set("Te", "trailers")
+		}
+	}
+	setForwardedHeaders(h, req)
+}
+
+// trustedProxies are the networks whose X-Forwarded-* and Forwarded headers
+// are believed; from anywhere else they are replaced. Empty until the proxy
+// starts, which trusts nobody.
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies reads TRUSTED_PROXIES, a comma separated list of CIDR
+// ranges or single addresses.
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// setupTrustedProxies loads TRUSTED_PROXIES and makes the client address used
+// for hashing and logging follow it.
+func setupTrustedProxies(app *echo.Echo) error {
+	networks, err := parseTrustedProxies(configs.AppConfig.GetOrDefault("TRUSTED_PROXIES", ""))
+	if err != nil {
+		return err
+	}
+	trustedProxies = networks
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, network := range networks {
+		options = append(options, echo.TrustIPRange(network))
+	}
+	clientIP = echo.ExtractIPFromXFFHeader(options...)
+	app.IPExtractor = clientIP
+	return nil
+}
+
+// isTrustedProxy reports whether the peer address belongs to a trusted proxy.
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwardedHeaders fills in the X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host and RFC 7239 Forwarded headers of the upstream request h for
+// the client request req. Values received from a trusted proxy are kept and
+// extended, from anyone else they are replaced.
+func setForwardedHeaders(h http.Header, req *http.Request) {
+	peer, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		peer = req.RemoteAddr
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	trusted := isTrustedProxy(net.ParseIP(peer))
+	if !trusted {
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+			h.Del(name)
+		}
+	}
+
+	if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+		h.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+peer)
+	} else {
+		h.Set("X-Forwarded-For", peer)
+	}
+	if h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", proto)
+	}
+	if h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", req.Host)
+	}
+
+	element := "for=" + forwardedNode(peer) + ";host=" + forwardedValue(req.Host) + ";proto=" + proto
+	if prior := h.Values("Forwarded"); len(prior) > 0 {
+		h.Set("Forwarded", strings.Join(prior, ", ")+", "+element)
+	} else {
+		h.Set("Forwarded", element)
+	}
+}
+
+// publicScheme returns the scheme the client used to reach the proxy, taking
+// X-Forwarded-Proto into account when a trusted proxy sent it.
+func publicScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	if proto := strings.ToLower(req.Header.Get("X-Forwarded-Proto")); (proto == "http" || proto == "https") && fromTrustedProxy(req) {
+		return proto
+	}
+	return "http"
+}
+
+// publicHost returns the host the client asked the proxy for, taking the first
+// X-Forwarded-Host entry into account when a trusted proxy sent it.
+func publicHost(req *http.Request) string {
+	if !fromTrustedProxy(req) {
+		return req.Host
+	}
+	host, _, _ := strings.Cut(req.Header.Get("X-Forwarded-Host"), ",")
+	host = strings.TrimSpace(host)
+	if host == "" || strings.ContainsAny(host, "/?#@ ") {
+		return req.Host
+	}
+	return host
+}
+
+// fromTrustedProxy reports whether the request's peer is a trusted proxy.
+func fromTrustedProxy(req *http.Request) bool {
+	peer, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		peer = req.RemoteAddr
+	}
+	return isTrustedProxy(net.ParseIP(peer))
+}
+
+// forwardedNode formats an address as a Forwarded node, with IPv6 addresses
+// bracketed and quoted as RFC 7239 section 6 requires.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return forwardedValue(ip)
+}
+
+// forwardedValue quotes a Forwarded parameter value unless it is a plain token.
+func forwardedValue(value string) string {
+	for _, r := range value {
+		if !isTokenChar(r) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	if value == "" {
+		return `""`
+	}
+	return value
+}
+
+// isTokenChar reports whether r may appear in an RFC 9110 token.
+func isTokenChar(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+// tracePropagator carries the W3C trace context and baggage from the client to
+// the upstream targets, whether or not the proxy records spans itself.
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
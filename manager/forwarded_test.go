@@ -0,0 +1,122 @@
+package manager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// trustProxies sets TRUSTED_PROXIES to value for the duration of the test.
+func trustProxies(t *testing.T, value string) {
+	t.Helper()
+	networks, err := parseTrustedProxies(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := trustedProxies
+	trustedProxies = networks
+	t.Cleanup(func() { trustedProxies = previous })
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8, 2001:db8::5")
+
+	for _, test := range []struct {
+		name  string
+		peer  string
+		sent  http.Header
+		wants map[string]string
+	}{
+		{
+			name: "trusted peer keeps and extends",
+			peer: "10.0.0.5:1234",
+			sent: http.Header{
+				"X-Forwarded-For":   {"203.0.113.7", "192.0.2.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"www.example.com"},
+				"Forwarded":         {"for=203.0.113.7;proto=https"},
+			},
+			wants: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7, 192.0.2.1, 10.0.0.5",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "www.example.com",
+				"Forwarded":         `for=203.0.113.7;proto=https, for=10.0.0.5;host="proxy.local:8700";proto=http`,
+			},
+		},
+		{
+			name: "untrusted peer is overwritten",
+			peer: "198.51.100.9:4000",
+			sent: http.Header{
+				"X-Forwarded-For":   {"203.0.113.7"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"www.example.com"},
+				"Forwarded":         {"for=203.0.113.7"},
+			},
+			wants: map[string]string{
+				"X-Forwarded-For":   "198.51.100.9",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "proxy.local:8700",
+				"Forwarded":         `for=198.51.100.9;host="proxy.local:8700";proto=http`,
+			},
+		},
+		{
+			name: "untrusted IPv6 peer is quoted",
+			peer: "[2001:db8::1]:4000",
+			sent: http.Header{"Forwarded": {"for=203.0.113.7"}},
+			wants: map[string]string{
+				"X-Forwarded-For": "2001:db8::1",
+				"Forwarded":       `for="[2001:db8::1]";host="proxy.local:8700";proto=http`,
+			},
+		},
+		{
+			name: "trusted IPv6 peer is appended",
+			peer: "[2001:db8::5]:4000",
+			sent: http.Header{"Forwarded": {`for="[2001:db8::9]"`}},
+			wants: map[string]string{
+				"Forwarded": `for="[2001:db8::9]", for="[2001:db8::5]";host="proxy.local:8700";proto=http`,
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = "proxy.local:8700"
+			req.RemoteAddr = test.peer
+			req.Header = test.sent
+
+			h := http.Header{}
+			copyRequestHeaders(h, req)
+			for name, want := range test.wants {
+				if got := h.Values(name); len(got) != 1 || got[0] != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyRequestHeadersDropsHopHeaders(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header = http.Header{
+		"Connection":          {"keep-alive, X-Hop-Secret", "Upgrade"},
+		"X-Hop-Secret":        {"only for the proxy"},
+		"Keep-Alive":          {"timeout=5"},
+		"Proxy-Authorization": {"Basic Zm9vOmJhcg=="},
+		"Upgrade":             {"h2c"},
+		"Te":                  {"trailers, deflate"},
+		"X-End-To-End":        {"kept"},
+	}
+
+	h := http.Header{}
+	copyRequestHeaders(h, req)
+	for _, name := range []string{"Connection", "X-Hop-Secret", "Keep-Alive", "Proxy-Authorization", "Upgrade"} {
+		if values := h.Values(name); len(values) > 0 {
+			t.Errorf("hop-by-hop header %s forwarded: %q", name, values)
+		}
+	}
+	if got := h.Get("Te"); got != "trailers" {
+		t.Errorf("Te = %q, want only trailers", got)
+	}
+	if got := h.Get("X-End-To-End"); got != "kept" {
+		t.Errorf("end-to-end header dropped, got %q", got)
+	}
+}
@@ -0,0 +1,149 @@
+package manager
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const (
+	hashStrategy = "hash"
+
+	// defaultHashReplicas is the number of points a target with weight 1 gets
+	// on the ring; more points spread the keys more evenly.
+	defaultHashReplicas = 160
+)
+
+// clientIP extracts the address of the client. It trusts X-Forwarded-For only
+// from the TRUSTED_PROXIES networks once the proxy has started.
+var clientIP = echo.ExtractIPFromXFFHeader()
+
+// HashKeyFunc extracts the affinity key of a request.
+type HashKeyFunc func(r *http.Request) string
+
+// newHashKeyFunc parses an LB_HASH_KEY value. Supported sources are "ip",
+// "header:<name>", "cookie:<name>" and "path:<segment>" where segment is the
+// 1-based position of the path segment to hash on. Requests that do not carry
+// the configured key fall back to the client IP.
+func newHashKeyFunc(source string) (HashKeyFunc, error) {
+	kind, name, _ := strings.Cut(source, ":")
+	var key HashKeyFunc
+
+	switch strings.ToLower(kind) {
+	case "", "ip":
+		return func(r *http.Request) string { return clientIP(r) }, nil
+	case "header":
+		if name == "" {
+			return nil, fmt.Errorf("hash key %q is missing the header name", source)
+		}
+		key = func(r *http.Request) string { return r.Header.Get(name) }
+	case "cookie":
+		if name == "" {
+			return nil, fmt.Errorf("hash key %q is missing the cookie name", source)
+		}
+		key = func(r *http.Request) string {
+			cookie, err := r.Cookie(name)
+			if err != nil {
+				return ""
+			}
+			return cookie.Value
+		}
+	case "path":
+		segment, err := strconv.Atoi(name)
+		if err != nil || segment < 1 {
+			return nil, fmt.Errorf("hash key %q needs a path segment starting at 1", source)
+		}
+		key = func(r *http.Request) string {
+			segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+			if segment > len(segments) {
+				return ""
+			}
+			return segments[segment-1]
+		}
+	default:
+		return nil, fmt.Errorf("unknown hash key source: %s", source)
+	}
+
+	return func(r *http.Request) string {
+		if value := key(r); value != "" {
+			return value
+		}
+		return clientIP(r)
+	}, nil
+}
+
+type ringPoint struct {
+	hash   uint64
+	target *middleware.ProxyTarget
+}
+
+// HashBalancer is a consistent hash (ring hash) balancer. Every target is
+// placed on the ring a number of times proportional to its weight, and a
+// request goes to the first target found clockwise from the hash of its key.
+// Since the points of a target only depend on its URL, adding or removing a
+// target only moves the keys that land next to its points.
+type HashBalancer struct {
+	Targets []*middleware.ProxyTarget
+	Key     HashKeyFunc
+	ring    []ringPoint
+}
+
+// NewHashBalancer builds the hash ring for the given targets.
+func NewHashBalancer(targets []*middleware.ProxyTarget, key HashKeyFunc, replicas int) *HashBalancer {
+	if replicas <= 0 {
+		replicas = defaultHashReplicas
+	}
+
+	var ring []ringPoint
+	for _, target := range targets {
+		points := replicas * targetWeight(target)
+		for i := 0; i < points; i++ {
+			ring = append(ring, ringPoint{
+				hash:   hashString(fmt.Sprintf("%s#%d", target.URL.String(), i)),
+				target: target,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	return &HashBalancer{Targets: targets, Key: key, ring: ring}
+}
+
+// NextTarget returns the target owning the request's key on the ring. When
+// that target is not available the walk continues clockwise, so only the keys
+// of the unavailable target move.
+func (h *HashBalancer) NextTarget(r *http.Request) *middleware.ProxyTarget {
+	if len(h.ring) == 0 {
+		return nil
+	}
+
+	hash := hashString(h.Key(r))
+	index := sort.Search(len(h.ring), func(i int) bool { return h.ring[i].hash >= hash })
+	for i := 0; i < len(h.ring); i++ {
+		point := h.ring[(index+i)%len(h.ring)]
+		if isAvailable(point.target) {
+			return point.target
+		}
+	}
+	return nil
+}
+
+// hashString hashes s with FNV-1a followed by a 64 bit finalizer, since plain
+// FNV spreads short, similar keys such as "host#1", "host#2" poorly.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,62 @@
+package manager
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// hashAssignments returns the target URL each of n keys is sent to.
+func hashAssignments(t *testing.T, targets []*middleware.ProxyTarget, n int) []string {
+	t.Helper()
+	key, err := newHashKeyFunc("header:X-Key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	balancer := NewHashBalancer(targets, key, defaultHashReplicas)
+	assigned := make([]string, n)
+	for i := range assigned {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Key", fmt.Sprintf("user-%d", i))
+		assigned[i] = balancer.NextTarget(req).URL.String()
+	}
+	return assigned
+}
+
+func TestHashRingRemapsOnlyAShareOfKeys(t *testing.T) {
+	const keys = 20000
+	var specs []helper.TargetSpec
+	for i := range 6 {
+		specs = append(specs, helper.TargetSpec{URL: fmt.Sprintf("http://ring-%d:80", i)})
+	}
+	targets := testTargets(t, specs...)
+	five := hashAssignments(t, targets[:5], keys)
+	six := hashAssignments(t, targets, keys)
+
+	// Adding a sixth target only moves keys onto it, about 1/6 of them
+	moved := 0
+	for i := range five {
+		if five[i] != six[i] {
+			moved++
+			if six[i] != targets[5].URL.String() {
+				t.Fatalf("key %d moved from %s to %s, not to the added target", i, five[i], six[i])
+			}
+		}
+	}
+	if share := float64(moved) / keys; share < 0.5/6 || share > 1.5/6 {
+		t.Fatalf("adding 1 of 6 targets moved %.1f%% of the keys, want about %.1f%%", share*100, 100.0/6)
+	}
+
+	// Removing a target only moves the keys it owned
+	removed := targets[2].URL.String()
+	without := hashAssignments(t, append(append([]*middleware.ProxyTarget{}, targets[:2]...), targets[3:5]...), keys)
+	for i := range five {
+		if five[i] != removed && without[i] != five[i] {
+			t.Fatalf("key %d moved from %s to %s although its target stayed", i, five[i], without[i])
+		}
+	}
+}
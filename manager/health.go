@@ -0,0 +1,288 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// statusRange is an inclusive range of HTTP status codes.
+type statusRange struct {
+	min, max int
+}
+
+// parseStatusRanges parses a list such as "200-299,304" into status ranges.
+func parseStatusRanges(value string) ([]statusRange, error) {
+	var ranges []statusRange
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		low, high, isRange := strings.Cut(part, "-")
+		if !isRange {
+			high = low
+		}
+		from, err := strconv.Atoi(strings.TrimSpace(low))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code %q", part)
+		}
+		to, err := strconv.Atoi(strings.TrimSpace(high))
+		if err != nil || to < from {
+			return nil, fmt.Errorf("invalid status range %q", part)
+		}
+		ranges = append(ranges, statusRange{min: from, max: to})
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("empty status range")
+	}
+	return ranges, nil
+}
+
+func statusInRanges(status int, ranges []statusRange) bool {
+	for _, r := range ranges {
+		if status >= r.min && status <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthCheckConfig holds the settings of the active health checks.
+type HealthCheckConfig struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	ExpectedStatus     []statusRange
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+// newHealthCheckConfig reads the health check settings, returning nil when
+// HEALTH_CHECK is not turned on.
+func newHealthCheckConfig() (*HealthCheckConfig, error) {
+	if configs.AppConfig.GetOrDefault("HEALTH_CHECK", "off") != "on" {
+		return nil, nil
+	}
+
+	interval, err := time.ParseDuration(configs.AppConfig.GetOrDefault("HEALTH_CHECK_INTERVAL", "10s"))
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid HEALTH_CHECK_INTERVAL: %q", configs.AppConfig.Get("HEALTH_CHECK_INTERVAL"))
+	}
+	timeout, err := time.ParseDuration(configs.AppConfig.GetOrDefault("HEALTH_CHECK_TIMEOUT", "2s"))
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid HEALTH_CHECK_TIMEOUT: %q", configs.AppConfig.Get("HEALTH_CHECK_TIMEOUT"))
+	}
+	expected, err := parseStatusRanges(configs.AppConfig.GetOrDefault("HEALTH_CHECK_EXPECTED_STATUS", "200-399"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HEALTH_CHECK_EXPECTED_STATUS: %w", err)
+	}
+	path := configs.AppConfig.GetOrDefault("HEALTH_CHECK_PATH", "/")
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid HEALTH_CHECK_PATH: %q, must start with /", path)
+	}
+	healthy, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("HEALTH_CHECK_HEALTHY_THRESHOLD", "2"))
+	unhealthy, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("HEALTH_CHECK_UNHEALTHY_THRESHOLD", "3"))
+
+	return &HealthCheckConfig{
+		Path:               path,
+		Interval:           interval,
+		Timeout:            timeout,
+		ExpectedStatus:     expected,
+		HealthyThreshold:   max(healthy, 1),
+		UnhealthyThreshold: max(unhealthy, 1),
+	}, nil
+}
+
+// HealthChecker periodically probes every target and flips its health state
+// once it passes or fails enough probes in a row. Targets start out healthy
+// so traffic flows before the first round of probes completes. Targets can
+// override the global settings through "health_check" in targets.json.
+type HealthChecker struct {
+	Config  *HealthCheckConfig
+	Targets func() []*middleware.ProxyTarget
+	stop    chan struct{}
+	once    sync.Once
+	next    map[string]time.Time // when each target is due for its next probe
+}
+
+// NewHealthChecker creates a health checker over the targets returned by
+// the given function, which is called again on every round.
+func NewHealthChecker(config *HealthCheckConfig, targets func() []*middleware.ProxyTarget) *HealthChecker {
+	return &HealthChecker{
+		Config:  config,
+		Targets: targets,
+		stop:    make(chan struct{}),
+		next:    map[string]time.Time{},
+	}
+}
+
+// configFor returns the health check settings of the target, applying its
+// overrides to the global settings.
+func (h *HealthChecker) configFor(target *middleware.ProxyTarget) *HealthCheckConfig {
+	override := targetHealthOverride(target)
+	if override == nil {
+		return h.Config
+	}
+
+	config := *h.Config
+	if override.Path != "" {
+		config.Path = override.Path
+	}
+	if override.Interval > 0 {
+		config.Interval = override.Interval
+	}
+	if override.Timeout > 0 {
+		config.Timeout = override.Timeout
+	}
+	if override.ExpectedStatus != nil {
+		config.ExpectedStatus = override.ExpectedStatus
+	}
+	if override.HealthyThreshold > 0 {
+		config.HealthyThreshold = override.HealthyThreshold
+	}
+	if override.UnhealthyThreshold > 0 {
+		config.UnhealthyThreshold = override.UnhealthyThreshold
+	}
+	return &config
+}
+
+// Start runs the health checks in the background until Stop is called.
+func (h *HealthChecker) Start() {
+	go func() {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-h.stop:
+				return
+			}
+			timer.Reset(h.checkDue())
+		}
+	}()
+}
+
+// Stop ends the background health checks.
+func (h *HealthChecker) Stop() {
+	h.once.Do(func() { close(h.stop) })
+}
+
+// checkDue probes the targets whose interval has elapsed and returns how long
+// to wait until the next target is due.
+func (h *HealthChecker) checkDue() time.Duration {
+	now := time.Now()
+	wait := h.Config.Interval
+	seen := map[string]bool{}
+
+	var wg sync.WaitGroup
+	for _, target := range h.Targets() {
+		key := target.URL.String()
+		config := h.configFor(target)
+		next, ok := h.next[key]
+		if ok && now.Before(next) {
+			wait = min(wait, next.Sub(now))
+			seen[key] = true
+			continue
+		}
+
+		h.next[key] = now.Add(config.Interval)
+		seen[key] = true
+		wait = min(wait, config.Interval)
+		wg.Add(1)
+		go func(target *middleware.ProxyTarget, config *HealthCheckConfig) {
+			defer wg.Done()
+			h.record(target, config, h.probe(target, config))
+		}(target, config)
+	}
+	wg.Wait()
+
+	// Forget targets removed from the pool
+	for key := range h.next {
+		if !seen[key] {
+			delete(h.next, key)
+		}
+	}
+	return max(wait-time.Since(now), 0)
+}
+
+// probe sends a single health check request to the target.
+func (h *HealthChecker) probe(target *middleware.ProxyTarget, config *HealthCheckConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	defer cancel()
+
+	// Raw TCP targets are healthy when they accept a connection
+	if target.URL.Scheme == "tcp" {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", target.URL.Host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(target.URL.String(), "/")+config.Path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "blue-proxy-health-check")
+	req.Host = hostPolicyOf(nil, target).host("", target)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfigForHost(target, req.Host),
+		},
+		// A redirect is an answer on its own, do not follow it
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if !statusInRanges(resp.StatusCode, config.ExpectedStatus) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// record applies the result of a probe to the target's health state.
+func (h *HealthChecker) record(target *middleware.ProxyTarget, config *HealthCheckConfig, err error) {
+	state := stateOf(target)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if err == nil {
+		state.checkFailures = 0
+		state.checkSuccesses++
+		if !state.healthy.Load() && state.checkSuccesses >= config.HealthyThreshold {
+			state.healthy.Store(true)
+			fmt.Printf("INFO: upstream target %s is healthy again\n", target.URL)
+		}
+	} else {
+		state.checkSuccesses = 0
+		state.checkFailures++
+		if state.healthy.Load() && state.checkFailures >= config.UnhealthyThreshold {
+			state.healthy.Store(false)
+			fmt.Printf("WARNING: upstream target %s is unhealthy: %v\n", target.URL, err)
+		}
+	}
+
+	healthy := 0.0
+	if state.healthy.Load() {
+		healthy = 1
+	}
+	upstreamHealthy.WithLabelValues(target.URL.String()).Set(healthy)
+}
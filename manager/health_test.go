@@ -0,0 +1,69 @@
+package manager
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+)
+
+func TestHealthThresholdTransitions(t *testing.T) {
+	targets := testTargets(t, helper.TargetSpec{URL: "http://health-a:80"})
+	target := targets[0]
+	config := &HealthCheckConfig{HealthyThreshold: 2, UnhealthyThreshold: 3}
+	checker := NewHealthChecker(config, nil)
+	failed := errors.New("probe failed")
+
+	for _, step := range []struct {
+		err     error
+		healthy bool
+	}{
+		{failed, true},
+		{failed, true},
+		{nil, true}, // a pass resets the failure run
+		{failed, true},
+		{failed, true},
+		{failed, false}, // third failure in a row
+		{nil, false},
+		{failed, false}, // a failure resets the pass run
+		{nil, false},
+		{nil, true}, // second pass in a row
+	} {
+		checker.record(target, config, step.err)
+		if got := stateOf(target).healthy.Load(); got != step.healthy {
+			t.Fatalf("after probe error %v healthy = %v, want %v", step.err, got, step.healthy)
+		}
+	}
+}
+
+func TestHealthProbeUsesConfiguredPath(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+	targets := testTargets(t, helper.TargetSpec{URL: backend.URL})
+	expected, _ := parseStatusRanges("200-299")
+	config := &HealthCheckConfig{Path: "/healthz", Timeout: time.Second, ExpectedStatus: expected}
+
+	if err := NewHealthChecker(config, nil).probe(targets[0], config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHealthOverrideRejectsRelativePath(t *testing.T) {
+	if _, err := parseHealthOverride(&helper.HealthCheckSpec{Path: "healthz"}); err == nil {
+		t.Fatal("health check path without a leading slash accepted")
+	}
+	if _, err := buildTargets([]helper.TargetSpec{{URL: "http://a:80", HealthCheck: &helper.HealthCheckSpec{Path: "healthz"}}}); err == nil {
+		t.Fatal("target with a relative health check path accepted")
+	}
+	override, err := parseHealthOverride(&helper.HealthCheckSpec{Path: "/healthz"})
+	if err != nil || override.Path != "/healthz" {
+		t.Fatalf("override %+v, %v", override, err)
+	}
+}
@@ -0,0 +1,186 @@
+package manager
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Host header policies.
+const (
+	hostPreserve = "preserve" // the Host the client sent
+	hostTarget   = "target"   // the host of the target URL
+	hostFixed    = "fixed"    // a configured host name
+)
+
+// hostPolicyKey is the echo context key holding the matched route's policy.
+const hostPolicyKey = "host_policy"
+
+// maxServerNames caps the transports kept per target for distinct SNI names,
+// since with the preserve policy the names come from the clients.
+const maxServerNames = 64
+
+// HostPolicy decides the Host header, and with it the TLS server name, of the
+// requests sent to a target.
+type HostPolicy struct {
+	Mode string
+	Host string // the host name of the fixed policy
+}
+
+// defaultHostPolicy is the policy of routes and targets without their own,
+// read from HOST_HEADER_POLICY when the proxy starts.
+var defaultHostPolicy = &HostPolicy{Mode: hostTarget}
+
+// newHostPolicy parses a host policy, nil when neither mode nor host is set. A
+// host without a mode is a fixed policy; a fixed policy without a host uses
+// TARGET_HOST_NAME.
+func newHostPolicy(mode, host string) (*HostPolicy, error) {
+	if mode == "" && host == "" {
+		return nil, nil
+	}
+	if mode == "" {
+		mode = hostFixed
+	}
+
+	switch mode {
+	case hostPreserve, hostTarget:
+		return &HostPolicy{Mode: mode}, nil
+	case hostFixed:
+		if host == "" {
+			host = configs.AppConfig.Get("TARGET_HOST_NAME")
+		}
+		if host == "" {
+			return nil, fmt.Errorf("host policy %q needs a host or TARGET_HOST_NAME", hostFixed)
+		}
+		return &HostPolicy{Mode: mode, Host: host}, nil
+	}
+	return nil, fmt.Errorf("unknown host policy %q", mode)
+}
+
+// newDefaultHostPolicy reads HOST_HEADER_POLICY.
+func newDefaultHostPolicy() (*HostPolicy, error) {
+	policy, err := newHostPolicy(configs.AppConfig.GetOrDefault("HOST_HEADER_POLICY", hostTarget), "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid HOST_HEADER_POLICY: %w", err)
+	}
+	return policy, nil
+}
+
+// hostPolicyOf returns the policy for a request to the target: the matched
+// route's, then the target's, then the default one. c may be nil for requests
+// the proxy makes on its own, such as health checks.
+func hostPolicyOf(c echo.Context, target *middleware.ProxyTarget) *HostPolicy {
+	if c != nil {
+		if policy, ok := c.Get(hostPolicyKey).(*HostPolicy); ok {
+			return policy
+		}
+	}
+	if policy, ok := target.Meta["host"].(*HostPolicy); ok {
+		return policy
+	}
+	return defaultHostPolicy
+}
+
+// host returns the Host header for a request to the target, given the Host
+// the client sent.
+func (p *HostPolicy) host(clientHost string, target *middleware.ProxyTarget) string {
+	switch p.Mode {
+	case hostPreserve:
+		if clientHost != "" {
+			return clientHost
+		}
+	case hostFixed:
+		return p.Host
+	}
+	return target.URL.Host
+}
+
+// serverName returns the TLS server name for a request to the target with the
+// given Host header, "" when the target's own configuration applies. The name
+// follows the Host header unless the target sets its own tls.server_name.
+func serverName(target *middleware.ProxyTarget, host string) string {
+	if target.URL.Scheme != "https" {
+		return ""
+	}
+	if spec := targetSpec(target); spec.TLS != nil && spec.TLS.ServerName != "" {
+		return ""
+	}
+	name := host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		name = hostname
+	}
+	if name == targetTLSConfig(target).ServerName {
+		return ""
+	}
+	return name
+}
+
+// tlsConfigForHost returns the client TLS configuration to reach the target
+// with the given Host header.
+func tlsConfigForHost(target *middleware.ProxyTarget, host string) *tls.Config {
+	config := targetTLSConfig(target)
+	if name := serverName(target, host); name != "" {
+		config = config.Clone()
+		config.ServerName = name
+	}
+	return config
+}
+
+// transportForHost returns the transport to reach the target with the given
+// Host header. Each TLS server name gets its own transport, as pooled
+// connections are shared by host and port alone.
+func transportForHost(target *middleware.ProxyTarget, host string) http.RoundTripper {
+	name := serverName(target, host)
+	if name == "" {
+		return targetTransport(target)
+	}
+	transports, ok := target.Meta["sni_transports"].(*serverNameTransports)
+	if !ok {
+		return targetTransport(target)
+	}
+	return transports.get(name, targetTLSConfig(target))
+}
+
+// serverNameTransports holds a target's transports for TLS server names other
+// than its own.
+type serverNameTransports struct {
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+func (s *serverNameTransports) get(serverName string, base *tls.Config) *http.Transport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if transport, ok := s.transports[serverName]; ok {
+		return transport
+	}
+
+	config := base.Clone()
+	config.ServerName = serverName
+	transport := newUpstreamTransport(config)
+	if len(s.transports) >= maxServerNames {
+		// Too many names to pool, do not keep this one's connection around
+		transport.DisableKeepAlives = true
+		return transport
+	}
+	if s.transports == nil {
+		s.transports = map[string]*http.Transport{}
+	}
+	s.transports[serverName] = transport
+	return transport
+}
+
+// closeIdle closes the idle connections of every transport.
+func (s *serverNameTransports) closeIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, transport := range s.transports {
+		transport.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,128 @@
+package manager
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	upstreamHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "blue_proxy",
+		Name:      "upstream_healthy",
+		Help:      "Whether the upstream target passes its health checks (1) or not (0).",
+	}, []string{"target"})
+
+	upstreamEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "blue_proxy",
+		Name:      "upstream_ejections_total",
+		Help:      "Number of times outlier detection ejected the upstream target.",
+	}, []string{"target"})
+
+	circuitStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "blue_proxy",
+		Name:      "circuit_breaker_state",
+		Help:      "State of the upstream target's circuit breaker: 0 closed, 1 half-open, 2 open.",
+	}, []string{"target"})
+
+	upstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "blue_proxy",
+		Name:      "upstream_retries_total",
+		Help:      "Number of requests retried on another target after the upstream target failed.",
+	}, []string{"target"})
+
+	retryBudgetExhausted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "blue_proxy",
+		Name:      "retry_budget_exhausted_total",
+		Help:      "Number of retries skipped because the retry budget was used up.",
+	})
+
+	mirrorRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "blue_proxy",
+		Name:      "mirror_requests_total",
+		Help:      "Number of shadow requests sent to a mirror pool, by response status (\"error\" when none came back).",
+	}, []string{"pool", "target", "status"})
+
+	mirrorDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "blue_proxy",
+		Name:      "mirror_request_duration_seconds",
+		Help:      "Latency of the shadow requests sent to a mirror pool.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"pool", "target"})
+
+	mirrorDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "blue_proxy",
+		Name:      "mirror_dropped_total",
+		Help:      "Number of requests not mirrored, by reason.",
+	}, []string{"pool", "reason"})
+
+	wsConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "blue_proxy",
+		Name:      "websocket_connections",
+		Help:      "Number of WebSocket sessions currently relayed to the upstream target.",
+	}, []string{"target"})
+
+	wsMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "blue_proxy",
+		Name:      "websocket_messages_total",
+		Help:      "Number of WebSocket messages relayed, \"upstream\" from the client to the target or \"downstream\".",
+	}, []string{"target", "direction"})
+
+	wsBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "blue_proxy",
+		Name:      "websocket_bytes_total",
+		Help:      "Payload bytes of the relayed WebSocket messages, by direction.",
+	}, []string{"target", "direction"})
+
+	wsSessionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "blue_proxy",
+		Name:      "websocket_session_duration_seconds",
+		Help:      "How long relayed WebSocket sessions stayed open.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10), // 1s to about 3 days
+	}, []string{"target"})
+
+	tcpConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "blue_proxy",
+		Name:      "tcp_connections",
+		Help:      "Number of TCP connections currently relayed from the listener to the upstream target.",
+	}, []string{"listener", "target"})
+
+	tcpBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "blue_proxy",
+		Name:      "tcp_bytes_total",
+		Help:      "Bytes relayed over TCP connections, \"upstream\" from the client to the target or \"downstream\".",
+	}, []string{"listener", "target", "direction"})
+
+	tcpConnectErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "blue_proxy",
+		Name:      "tcp_connect_errors_total",
+		Help:      "Number of failed connections from a TCP listener to the upstream target.",
+	}, []string{"listener", "target"})
+
+	tcpDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "blue_proxy",
+		Name:      "tcp_dropped_total",
+		Help:      "Number of accepted TCP connections closed without reaching a target, by reason.",
+	}, []string{"listener", "reason"})
+)
+
+// startMetricsServer exposes the Prometheus metrics on METRICS_PORT. It is kept
+// off the proxy listener so /metrics stays free for the proxied services.
+func startMetricsServer() {
+	port := configs.AppConfig.Get("METRICS_PORT")
+	if port == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe("0.0.0.0:"+port, mux); err != nil {
+			fmt.Printf("WARNING: metrics server stopped: %v\n", err)
+		}
+	}()
+}
@@ -0,0 +1,236 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/labstack/echo/v4"
+)
+
+// Mirror copies a share of a route's requests to a shadow pool.
+type Mirror struct {
+	PoolName string
+	Pool     *Pool
+	Percent  float64
+}
+
+// buildMirror resolves the shadow pool of a route, nil when it mirrors nothing.
+func (r *Router) buildMirror(spec *helper.MirrorSpec) (*Mirror, error) {
+	if spec == nil {
+		return nil, nil
+	}
+	pool, ok := r.Pools[spec.Pool]
+	if !ok {
+		return nil, fmt.Errorf("mirror to unknown pool %q", spec.Pool)
+	}
+	percent := 100.0
+	if spec.Percent != nil {
+		percent = *spec.Percent
+	}
+	if percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("invalid mirror percent %v for pool %q", percent, spec.Pool)
+	}
+	return &Mirror{PoolName: spec.Pool, Pool: pool, Percent: percent}, nil
+}
+
+// mirrorQueue sends the shadow requests of every route, nil until the proxy
+// starts.
+var mirrorQueue *MirrorQueue
+
+// MirrorQueue sends shadow requests from a fixed set of workers. Requests that
+// do not fit in the queue are dropped so the primary path never waits on the
+// shadow pool.
+type MirrorQueue struct {
+	Workers      int
+	Timeout      time.Duration
+	MaxBodyBytes int64
+
+	jobs   chan *mirrorJob
+	wg     sync.WaitGroup
+	mu     sync.RWMutex // guards closed against sends on the closed channel
+	closed bool
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// mirrorJob is a cloned request waiting to be sent to a shadow pool.
+type mirrorJob struct {
+	mirror *Mirror
+	method string
+	uri    string
+	host   string
+	policy *HostPolicy // the route's host policy, nil to use the target's
+	header http.Header
+	body   []byte
+}
+
+// newMirrorQueue reads the mirroring settings.
+func newMirrorQueue() (*MirrorQueue, error) {
+	timeout, err := time.ParseDuration(configs.AppConfig.GetOrDefault("MIRROR_TIMEOUT", "5s"))
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid MIRROR_TIMEOUT: %q", configs.AppConfig.Get("MIRROR_TIMEOUT"))
+	}
+	workers, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("MIRROR_WORKERS", "8"))
+	queueSize, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("MIRROR_QUEUE_SIZE", "1000"))
+	maxBody, _ := strconv.ParseInt(configs.AppConfig.GetOrDefault("MIRROR_MAX_BODY_BYTES", "1048576"), 10, 64)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MirrorQueue{
+		Workers:      max(workers, 1),
+		Timeout:      timeout,
+		MaxBodyBytes: max(maxBody, 0),
+		jobs:         make(chan *mirrorJob, max(queueSize, 0)),
+		ctx:          ctx,
+		cancel:       cancel,
+	}, nil
+}
+
+// Start runs the workers in the background until Stop is called.
+func (q *MirrorQueue) Start() {
+	for range q.Workers {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for job := range q.jobs {
+				q.send(job)
+			}
+		}()
+	}
+}
+
+// Stop aborts the shadow requests in flight, drops the queued ones and waits
+// for the workers to exit.
+func (q *MirrorQueue) Stop() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		q.cancel()
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+// enqueue queues the job unless the queue is full or stopped.
+func (q *MirrorQueue) enqueue(job *mirrorJob) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false
+	}
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// mirrorRequest clones the request for the route's shadow pool when it is
+// sampled. The body is buffered and put back so the primary request still
+// reads it; bodies over MaxBodyBytes are not mirrored.
+func mirrorRequest(c echo.Context, mirror *Mirror) {
+	if mirrorQueue == nil || rand.Float64()*100 >= mirror.Percent {
+		return
+	}
+	q := mirrorQueue
+
+	req := c.Request()
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0 {
+		if req.ContentLength > q.MaxBodyBytes {
+			mirrorDropped.WithLabelValues(mirror.PoolName, "body_too_large").Inc()
+			return
+		}
+		buffered, err := io.ReadAll(io.LimitReader(req.Body, q.MaxBodyBytes+1))
+		// Put back what was read, followed by anything left
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buffered), req.Body), req.Body}
+		if err != nil || int64(len(buffered)) > q.MaxBodyBytes {
+			mirrorDropped.WithLabelValues(mirror.PoolName, "body_too_large").Inc()
+			return
+		}
+		body = buffered
+	}
+
+	header := http.Header{}
+	copyRequestHeaders(header, req)
+	job := &mirrorJob{
+		mirror: mirror,
+		method: req.Method,
+		uri:    upstreamURI(c),
+		host:   req.Host,
+		header: header,
+		body:   body,
+	}
+	job.policy, _ = c.Get(hostPolicyKey).(*HostPolicy)
+	if !q.enqueue(job) {
+		mirrorDropped.WithLabelValues(mirror.PoolName, "queue_full").Inc()
+	}
+}
+
+// send sends one shadow request and records its outcome; the response is
+// thrown away.
+func (q *MirrorQueue) send(job *mirrorJob) {
+	if q.ctx.Err() != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(q.ctx, q.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, job.method, "/", bytes.NewReader(job.body))
+	if err != nil {
+		return
+	}
+	req.Header = job.header
+	req.Host = job.host
+
+	target, done := pickTarget(job.mirror.Pool.Balancer(), req)
+	if target == nil {
+		mirrorDropped.WithLabelValues(job.mirror.PoolName, "no_target").Inc()
+		return
+	}
+	defer done()
+
+	req.URL, err = url.Parse(target.URL.String() + job.uri)
+	if err != nil {
+		return
+	}
+	policy := job.policy
+	if policy == nil {
+		policy = hostPolicyOf(nil, target)
+	}
+	host := policy.host(job.host, target)
+	req.Host = host
+
+	client := &http.Client{
+		Transport: transportForHost(target, host),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	status := "error"
+	if err == nil {
+		stateOf(target).observeLatency(time.Since(start))
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	mirrorRequests.WithLabelValues(job.mirror.PoolName, target.URL.String(), status).Inc()
+	mirrorDuration.WithLabelValues(job.mirror.PoolName, target.URL.String()).Observe(time.Since(start).Seconds())
+}
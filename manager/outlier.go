@@ -0,0 +1,163 @@
+package manager
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// outlierDetector is the passive outlier detection of the proxy, nil when
+// OUTLIER_DETECTION is turned off.
+var outlierDetector *OutlierDetector
+
+// OutlierDetector ejects targets based on the outcome of real traffic, in the
+// spirit of Envoy's outlier detection. A target is ejected after a run of
+// consecutive failures, or when its failure rate within an interval goes over
+// the threshold. Each repeated ejection lasts longer than the previous one, and
+// targets are never ejected past the point where less than the minimum
+// serving percentage of the pool would be left.
+type OutlierDetector struct {
+	ConsecutiveFailures int
+	FailureRate         int // percent
+	MinRequests         int
+	Interval            time.Duration
+	BaseEjectionTime    time.Duration
+	MaxEjectionTime     time.Duration
+	MinServingPercent   int
+	Pools               func() []*Pool
+
+	// ejectMu makes counting a pool's ejected targets and ejecting one more a
+	// single step, so concurrent failures cannot together drain a pool below
+	// MinServingPercent
+	ejectMu sync.Mutex
+}
+
+// newOutlierDetector reads the outlier detection settings, returning nil when
+// OUTLIER_DETECTION is not turned on.
+func newOutlierDetector(pools func() []*Pool) (*OutlierDetector, error) {
+	if configs.AppConfig.GetOrDefault("OUTLIER_DETECTION", "off") != "on" {
+		return nil, nil
+	}
+
+	interval, err := time.ParseDuration(configs.AppConfig.GetOrDefault("OUTLIER_INTERVAL", "10s"))
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid OUTLIER_INTERVAL: %q", configs.AppConfig.Get("OUTLIER_INTERVAL"))
+	}
+	baseEjection, err := time.ParseDuration(configs.AppConfig.GetOrDefault("OUTLIER_BASE_EJECTION_TIME", "30s"))
+	if err != nil || baseEjection <= 0 {
+		return nil, fmt.Errorf("invalid OUTLIER_BASE_EJECTION_TIME: %q", configs.AppConfig.Get("OUTLIER_BASE_EJECTION_TIME"))
+	}
+	maxEjection, err := time.ParseDuration(configs.AppConfig.GetOrDefault("OUTLIER_MAX_EJECTION_TIME", "5m"))
+	if err != nil || maxEjection < baseEjection {
+		return nil, fmt.Errorf("invalid OUTLIER_MAX_EJECTION_TIME: %q", configs.AppConfig.Get("OUTLIER_MAX_EJECTION_TIME"))
+	}
+	consecutive, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("OUTLIER_CONSECUTIVE_FAILURES", "5"))
+	failureRate, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("OUTLIER_FAILURE_RATE", "50"))
+	minRequests, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("OUTLIER_MIN_REQUESTS", "20"))
+	minServing, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("OUTLIER_MIN_SERVING_PERCENT", "50"))
+
+	return &OutlierDetector{
+		ConsecutiveFailures: consecutive,
+		FailureRate:         failureRate,
+		MinRequests:         max(minRequests, 1),
+		Interval:            interval,
+		BaseEjectionTime:    baseEjection,
+		MaxEjectionTime:     maxEjection,
+		MinServingPercent:   min(max(minServing, 0), 100),
+		Pools:               pools,
+	}, nil
+}
+
+// reportResult feeds the outcome of a request into the outlier detection,
+// when it is turned on.
+func reportResult(target *middleware.ProxyTarget, success bool) {
+	if outlierDetector != nil {
+		outlierDetector.Record(target, success)
+	}
+}
+
+// Record registers the outcome of a request to the target and ejects the
+// target when it crosses one of the thresholds.
+func (o *OutlierDetector) Record(target *middleware.ProxyTarget, success bool) {
+	state := stateOf(target)
+	now := time.Now()
+
+	state.mu.Lock()
+	if now.Sub(state.windowStart) >= o.Interval {
+		// A full interval without being ejected lowers the next ejection time
+		if state.ejections > 0 && !state.ejected(now) {
+			state.ejections--
+		}
+		state.windowStart = now
+		state.windowRequests, state.windowFailures = 0, 0
+	}
+
+	state.windowRequests++
+	if success {
+		state.consecutiveFailures = 0
+		state.mu.Unlock()
+		return
+	}
+	state.windowFailures++
+	state.consecutiveFailures++
+
+	reason := ""
+	switch {
+	case state.ejected(now):
+	case o.ConsecutiveFailures > 0 && state.consecutiveFailures >= o.ConsecutiveFailures:
+		reason = fmt.Sprintf("%d consecutive failures", state.consecutiveFailures)
+	case o.FailureRate > 0 && state.windowRequests >= o.MinRequests &&
+		state.windowFailures*100 >= o.FailureRate*state.windowRequests:
+		reason = fmt.Sprintf("failure rate %d%% over %d requests", state.windowFailures*100/state.windowRequests, state.windowRequests)
+	}
+	state.mu.Unlock()
+
+	if reason != "" {
+		o.eject(target, reason)
+	}
+}
+
+// eject takes the target out of rotation unless that would leave less than the
+// minimum serving percentage of any pool the target belongs to.
+func (o *OutlierDetector) eject(target *middleware.ProxyTarget, reason string) {
+	o.ejectMu.Lock()
+	defer o.ejectMu.Unlock()
+
+	now := time.Now()
+	if stateOf(target).ejected(now) {
+		return // a concurrent failure got here first
+	}
+	for _, pool := range o.Pools() {
+		targets := pool.Targets()
+		member, ejected := false, 0
+		for _, t := range targets {
+			if t.URL.String() == target.URL.String() {
+				member = true
+			}
+			if stateOf(t).ejected(now) {
+				ejected++
+			}
+		}
+		if member && (len(targets)-ejected-1)*100 < o.MinServingPercent*len(targets) {
+			fmt.Printf("WARNING: not ejecting upstream target %s (%s), minimum serving percentage reached\n", target.URL, reason)
+			return
+		}
+	}
+
+	state := stateOf(target)
+	state.mu.Lock()
+	state.ejections++
+	duration := min(o.BaseEjectionTime*time.Duration(state.ejections), o.MaxEjectionTime)
+	state.ejectedUntil.Store(now.Add(duration).UnixNano())
+	state.consecutiveFailures = 0
+	state.windowStart = now
+	state.windowRequests, state.windowFailures = 0, 0
+	state.mu.Unlock()
+
+	upstreamEjections.WithLabelValues(target.URL.String()).Inc()
+	fmt.Printf("WARNING: upstream target %s ejected for %v: %s\n", target.URL, duration, reason)
+}
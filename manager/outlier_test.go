@@ -0,0 +1,95 @@
+package manager
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDetector builds an outlier detector over one pool of n targets.
+func testDetector(t *testing.T, n int, minServing int) (*OutlierDetector, *Pool) {
+	t.Helper()
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://%s-%d:80", t.Name(), i)
+	}
+	pool := testPool(t, "outlier", urls...)
+	detector := &OutlierDetector{
+		ConsecutiveFailures: 3,
+		MinRequests:         1,
+		Interval:            time.Minute,
+		BaseEjectionTime:    time.Minute,
+		MaxEjectionTime:     3 * time.Minute,
+		MinServingPercent:   minServing,
+		Pools:               func() []*Pool { return []*Pool{pool} },
+	}
+	return detector, pool
+}
+
+func TestOutlierEjectsAfterConsecutiveFailures(t *testing.T) {
+	detector, pool := testDetector(t, 4, 0)
+	target := pool.Targets()[0]
+
+	detector.Record(target, false)
+	detector.Record(target, false)
+	detector.Record(target, true) // a success resets the run
+	detector.Record(target, false)
+	detector.Record(target, false)
+	if stateOf(target).ejected(time.Now()) {
+		t.Fatal("ejected before 3 consecutive failures")
+	}
+	detector.Record(target, false)
+	if !stateOf(target).ejected(time.Now()) {
+		t.Fatal("not ejected after 3 consecutive failures")
+	}
+	if isAvailable(target) {
+		t.Fatal("ejected target still available")
+	}
+}
+
+func TestOutlierEjectionTimeGrowsUpToMax(t *testing.T) {
+	detector, pool := testDetector(t, 4, 0)
+	target := pool.Targets()[0]
+	state := stateOf(target)
+
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		state.ejectedUntil.Store(0) // the previous ejection ran out
+		before := time.Now()
+		detector.eject(target, "test")
+		got := time.Unix(0, state.ejectedUntil.Load()).Sub(before)
+		if got < want || got > want+time.Second {
+			t.Fatalf("ejection %d lasts %v, want %v", i+1, got, want)
+		}
+	}
+}
+
+func TestOutlierKeepsMinServingPercent(t *testing.T) {
+	for range 20 {
+		detector, pool := testDetector(t, 4, 50)
+
+		// Every target fails at once; only half of the pool may go
+		var wg sync.WaitGroup
+		for _, target := range pool.Targets() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				detector.eject(target, "test")
+			}()
+		}
+		wg.Wait()
+
+		ejected := 0
+		for _, target := range pool.Targets() {
+			if stateOf(target).ejected(time.Now()) {
+				ejected++
+			}
+		}
+		if ejected != 2 {
+			t.Fatalf("%d of 4 targets ejected with a 50%% minimum serving", ejected)
+		}
+		for _, target := range pool.Targets() {
+			upstreamStates.Delete(target.URL.String())
+		}
+	}
+}
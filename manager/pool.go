@@ -0,0 +1,92 @@
+package manager
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// poolSnapshot is one version of a pool's target list and the balancer built
+// over it. A snapshot is never modified, reloads swap in a new one.
+type poolSnapshot struct {
+	targets  []*middleware.ProxyTarget
+	balancer Balancer
+}
+
+// Pool is a group of upstream targets served by one balancer. Its target list
+// can be replaced at runtime; requests already in flight keep the targets
+// they picked from the previous list.
+type Pool struct {
+	Name     string
+	Strategy string
+	TCP      bool // the targets are raw TCP ("tcp://") endpoints
+	current  atomic.Pointer[poolSnapshot]
+}
+
+// NewPool creates the named pool balancing over the targets with the given
+// strategy.
+func NewPool(name, strategy string, targets []*middleware.ProxyTarget) (*Pool, error) {
+	pool := &Pool{Name: name, Strategy: strategy}
+	if err := pool.SetTargets(targets); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// Targets returns the current target list of the pool.
+func (p *Pool) Targets() []*middleware.ProxyTarget {
+	return p.current.Load().targets
+}
+
+// Balancer returns the balancer over the current target list.
+func (p *Pool) Balancer() Balancer {
+	return p.current.Load().balancer
+}
+
+// SetTargets atomically replaces the targets of the pool with a fresh balancer.
+// Targets flagged as backup only receive traffic while none of the primary
+// targets is available.
+func (p *Pool) SetTargets(targets []*middleware.ProxyTarget) error {
+	var primary, backup []*middleware.ProxyTarget
+	for _, target := range targets {
+		if targetSpec(target).Backup {
+			backup = append(backup, target)
+		} else {
+			primary = append(primary, target)
+		}
+	}
+	if len(primary) == 0 {
+		primary, backup = backup, nil
+	}
+
+	balancer, err := newBalancer(p.Strategy, primary)
+	if err != nil {
+		return err
+	}
+	if len(backup) > 0 {
+		backupBalancer, err := newBalancer(p.Strategy, backup)
+		if err != nil {
+			return err
+		}
+		balancer = &failoverBalancer{primary: balancer, backup: backupBalancer}
+	}
+
+	p.current.Store(&poolSnapshot{targets: targets, balancer: balancer})
+	return nil
+}
+
+// failoverBalancer uses the backup targets only when the primary balancer has
+// no available target.
+type failoverBalancer struct {
+	primary Balancer
+	backup  Balancer
+}
+
+// NextTarget returns a primary target, or a backup one when none is available
+func (f *failoverBalancer) NextTarget(r *http.Request) *middleware.ProxyTarget {
+	if target := f.primary.NextTarget(r); target != nil {
+		return target
+	}
+	return f.backup.NextTarget(r)
+}
@@ -0,0 +1,148 @@
+package manager
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Upstream redirect modes.
+const (
+	redirectPassthrough = "passthrough" // hand 3xx responses to the client
+	redirectFollow      = "follow"      // follow them server side
+)
+
+// RedirectPolicy decides how redirects from the upstream targets are handled
+// and how the response headers naming the upstream are rewritten.
+type RedirectPolicy struct {
+	Mode string
+	// CookieDomains maps Set-Cookie Domain attributes to their public value,
+	// lower cased and without a leading dot.
+	CookieDomains map[string]string
+	// CookiePaths rewrites Set-Cookie Path attributes starting with a prefix.
+	CookiePaths []cookiePathRewrite
+}
+
+type cookiePathRewrite struct {
+	from, to string
+}
+
+// redirectPolicy is the redirect handling of the proxy, read from
+// UPSTREAM_REDIRECTS and the COOKIE_*_REWRITE settings when it starts.
+var redirectPolicy = &RedirectPolicy{Mode: redirectPassthrough}
+
+// newRedirectPolicy reads the redirect and cookie rewrite settings.
+func newRedirectPolicy() (*RedirectPolicy, error) {
+	policy := &RedirectPolicy{
+		Mode:          strings.ToLower(configs.AppConfig.GetOrDefault("UPSTREAM_REDIRECTS", redirectPassthrough)),
+		CookieDomains: map[string]string{},
+	}
+	if policy.Mode != redirectPassthrough && policy.Mode != redirectFollow {
+		return nil, fmt.Errorf("invalid UPSTREAM_REDIRECTS: %q", policy.Mode)
+	}
+
+	domains, err := parseRewritePairs(configs.AppConfig.Get("COOKIE_DOMAIN_REWRITE"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid COOKIE_DOMAIN_REWRITE: %w", err)
+	}
+	for _, pair := range domains {
+		policy.CookieDomains[strings.TrimPrefix(strings.ToLower(pair[0]), ".")] = pair[1]
+	}
+	paths, err := parseRewritePairs(configs.AppConfig.Get("COOKIE_PATH_REWRITE"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid COOKIE_PATH_REWRITE: %w", err)
+	}
+	for _, pair := range paths {
+		policy.CookiePaths = append(policy.CookiePaths, cookiePathRewrite{from: pair[0], to: pair[1]})
+	}
+	return policy, nil
+}
+
+// parseRewritePairs parses a comma separated list of "from=to" pairs.
+func parseRewritePairs(value string) ([][2]string, error) {
+	var pairs [][2]string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(entry, "=")
+		if !ok || from == "" {
+			return nil, fmt.Errorf("%q is not a from=to pair", entry)
+		}
+		pairs = append(pairs, [2]string{strings.TrimSpace(from), strings.TrimSpace(to)})
+	}
+	return pairs, nil
+}
+
+// checkRedirect is the CheckRedirect of the upstream clients.
+func (p *RedirectPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if p.Mode == redirectPassthrough {
+		return http.ErrUseLastResponse
+	}
+	// Limit the number of redirects
+	if len(via) >= 10 {
+		return fmt.Errorf("too many redirects")
+	}
+	return nil // Follow the redirect
+}
+
+// rewriteResponse points the Location and Content-Location headers that name
+// the upstream (its URL host or the Host header it was sent) at the address
+// the client used, and applies the cookie rewrites to Set-Cookie.
+func (p *RedirectPolicy) rewriteResponse(c echo.Context, target *middleware.ProxyTarget, upstreamHost string, resp *http.Response) {
+	public := &url.URL{Scheme: publicScheme(c.Request()), Host: publicHost(c.Request())}
+	for _, name := range []string{"Location", "Content-Location"} {
+		value := resp.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		location, err := url.Parse(value)
+		if err != nil || location.Host == "" {
+			continue // relative references already resolve against the proxy
+		}
+		if !strings.EqualFold(location.Host, target.URL.Host) && !strings.EqualFold(location.Host, upstreamHost) {
+			continue
+		}
+		location.Scheme, location.Host = public.Scheme, public.Host
+		resp.Header.Set(name, location.String())
+	}
+
+	if len(p.CookieDomains) == 0 && len(p.CookiePaths) == 0 || len(resp.Header.Values("Set-Cookie")) == 0 {
+		return
+	}
+	cookies := resp.Header.Values("Set-Cookie")
+	rewritten := make([]string, len(cookies))
+	for i, cookie := range cookies {
+		rewritten[i] = p.rewriteCookie(cookie)
+	}
+	resp.Header["Set-Cookie"] = rewritten
+}
+
+// rewriteCookie rewrites the Domain and Path attributes of a Set-Cookie value,
+// leaving the rest of it as the upstream wrote it.
+func (p *RedirectPolicy) rewriteCookie(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	for i, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch strings.ToLower(name) {
+		case "domain":
+			if to, ok := p.CookieDomains[strings.TrimPrefix(strings.ToLower(value), ".")]; ok {
+				parts[i+1] = " " + name + "=" + to
+			}
+		case "path":
+			for _, rewrite := range p.CookiePaths {
+				if strings.HasPrefix(value, rewrite.from) {
+					parts[i+1] = " " + name + "=" + rewrite.to + strings.TrimPrefix(value, rewrite.from)
+					break
+				}
+			}
+		}
+	}
+	return strings.Join(parts, ";")
+}
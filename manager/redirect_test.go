@@ -0,0 +1,42 @@
+package manager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/labstack/echo/v4"
+)
+
+func TestRewriteResponseUsesTrustedForwardedHost(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8")
+
+	targets, err := buildTargets([]helper.TargetSpec{{URL: "http://backend.internal:8080"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &RedirectPolicy{Mode: redirectPassthrough}
+
+	for _, test := range []struct {
+		name, peer, want string
+	}{
+		{"trusted proxy", "10.1.2.3:4000", "https://www.example.com/login"},
+		{"untrusted client", "203.0.113.9:4000", "http://proxy.local:8700/login"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = "proxy.local:8700"
+			req.RemoteAddr = test.peer
+			req.Header.Set("X-Forwarded-Host", "www.example.com, proxy.local:8700")
+			req.Header.Set("X-Forwarded-Proto", "https")
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+
+			resp := &http.Response{Header: http.Header{"Location": {"http://backend.internal:8080/login"}}}
+			policy.rewriteResponse(c, targets[0], "backend.internal:8080", resp)
+			if got := resp.Header.Get("Location"); got != test.want {
+				t.Fatalf("Location %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package manager
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// TargetsWatcher reloads targets.json into the running route table when the
+// process receives SIGHUP and, with Poll set, when the file changes. The file
+// is polled for changes of its modification time and size, which also works
+// on network and container mounts where file system notifications are
+// unreliable.
+type TargetsWatcher struct {
+	Path     string
+	Interval time.Duration
+	Poll     bool // also reload when the file changes, see TARGETS_WATCH
+	Routes   *RouteTable
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	stop    chan struct{}
+	once    sync.Once
+	running sync.WaitGroup
+}
+
+// NewTargetsWatcher creates a watcher reloading path into the route table.
+func NewTargetsWatcher(path string, routes *RouteTable) *TargetsWatcher {
+	interval, err := time.ParseDuration(configs.AppConfig.GetOrDefault("TARGETS_WATCH_INTERVAL", "2s"))
+	if err != nil || interval <= 0 {
+		fmt.Printf("WARNING: invalid TARGETS_WATCH_INTERVAL, using 2s\n")
+		interval = 2 * time.Second
+	}
+
+	watcher := &TargetsWatcher{
+		Path:     path,
+		Interval: interval,
+		Poll:     configs.AppConfig.GetOrDefault("TARGETS_WATCH", "on") == "on",
+		Routes:   routes,
+		stop:     make(chan struct{}),
+	}
+	if info, err := os.Stat(path); err == nil {
+		watcher.modTime, watcher.size = info.ModTime(), info.Size()
+	}
+	return watcher
+}
+
+// Start watches SIGHUP, and the file when polling, in the background until
+// Stop is called. SIGHUP is caught from here on so it no longer ends the
+// process.
+func (w *TargetsWatcher) Start() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	w.running.Add(1)
+	go func() {
+		defer w.running.Done()
+		defer signal.Stop(hangup)
+		var polls <-chan time.Time
+		if w.Poll {
+			ticker := time.NewTicker(w.Interval)
+			defer ticker.Stop()
+			polls = ticker.C
+		}
+		for {
+			select {
+			case <-polls:
+				if w.changed() {
+					w.Reload()
+				}
+			case <-hangup:
+				fmt.Println("INFO: SIGHUP received, reloading targets")
+				w.changed() // remember the file state so the next poll does not reload again
+				w.Reload()
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the watcher, waiting for a reload in progress to finish.
+func (w *TargetsWatcher) Stop() {
+	w.once.Do(func() { close(w.stop) })
+	w.running.Wait()
+}
+
+// changed reports whether the file changed since it was last seen.
+func (w *TargetsWatcher) changed() bool {
+	info, err := os.Stat(w.Path)
+	if err != nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return false
+	}
+	w.modTime, w.size = info.ModTime(), info.Size()
+	return true
+}
+
+// Reload reads and validates the file and swaps the new pools and routes in.
+// An invalid file is logged and the running configuration is kept.
+func (w *TargetsWatcher) Reload() {
+	loaded, err := helper.ReadTargets(w.Path)
+	if err != nil {
+		fmt.Printf("WARNING: targets not reloaded: %v\n", err)
+		return
+	}
+
+	previous := w.Routes.Targets()
+	if err := w.Routes.Load(loaded); err != nil {
+		fmt.Printf("WARNING: targets not reloaded: %v\n", err)
+		return
+	}
+	helper.Targets = loaded
+
+	targets := w.Routes.Targets()
+	pruneTransports(targets)
+	added, removed := diffTargets(previous, targets)
+	fmt.Printf("INFO: targets reloaded from %s, %d pools, %d targets, added: %v, removed: %v\n",
+		w.Path, len(w.Routes.Router().Pools), len(targets), added, removed)
+}
+
+// diffTargets lists the target URLs only present in next (added) and only
+// present in previous (removed).
+func diffTargets(previous, next []*middleware.ProxyTarget) (added, removed []string) {
+	seen := map[string]bool{}
+	for _, target := range previous {
+		seen[target.URL.String()] = true
+	}
+	for _, target := range next {
+		key := target.URL.String()
+		if !seen[key] {
+			added = append(added, key)
+		}
+		delete(seen, key)
+	}
+	for _, target := range previous {
+		if seen[target.URL.String()] {
+			removed = append(removed, target.URL.String())
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,43 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+)
+
+func TestSighupReloadsWithoutPolling(t *testing.T) {
+	previous := helper.Targets
+	t.Cleanup(func() { helper.Targets = previous })
+
+	routes, err := NewRouteTable(helper.Target{Targets: []helper.TargetSpec{{URL: "http://before:80"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "targets.json")
+	if err := os.WriteFile(path, []byte(`{"targets": ["http://after:80"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := NewTargetsWatcher(path, routes)
+	watcher.Poll = false
+	watcher.Start()
+	defer watcher.Stop()
+
+	// Without the watcher's handler SIGHUP would end the test binary
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if targets := routes.Targets(); len(targets) == 1 && targets[0].URL.Host == "after:80" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("targets after SIGHUP: %v", routes.Targets()[0].URL)
+}
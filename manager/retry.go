@@ -0,0 +1,264 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// RetryPolicy decides when a failed upstream call is tried again on another
+// target. Idempotent requests are retried on connection errors and on the
+// configured status codes; any request is retried when it failed before it
+// was written to the upstream.
+type RetryPolicy struct {
+	Attempts      int           // retries after the first try
+	PerTryTimeout time.Duration // time each try has to return response headers, 0 for none
+	BackoffBase   time.Duration
+	BackoffMax    time.Duration
+	RetryOn       []statusRange
+	MaxBodyBytes  int64 // request bodies up to this size are buffered for replay
+
+	// The retry budget caps the retries in flight to BudgetPercent of the
+	// active requests, but always allows MinRetryConcurrency of them.
+	BudgetPercent       int
+	MinRetryConcurrency int
+}
+
+// retryPolicy is the retry policy of the proxy, nil when RETRY_ATTEMPTS is 0.
+var retryPolicy *RetryPolicy
+
+var (
+	activeRequests atomic.Int64
+	activeRetries  atomic.Int64
+)
+
+// newRetryPolicy reads the retry settings, returning nil when retries are off.
+func newRetryPolicy() (*RetryPolicy, error) {
+	attempts, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("RETRY_ATTEMPTS", "0"))
+	if attempts <= 0 {
+		return nil, nil
+	}
+
+	perTry, err := time.ParseDuration(configs.AppConfig.GetOrDefault("RETRY_PER_TRY_TIMEOUT", "0s"))
+	if err != nil || perTry < 0 {
+		return nil, fmt.Errorf("invalid RETRY_PER_TRY_TIMEOUT: %q", configs.AppConfig.Get("RETRY_PER_TRY_TIMEOUT"))
+	}
+	backoffBase, err := time.ParseDuration(configs.AppConfig.GetOrDefault("RETRY_BACKOFF_BASE", "25ms"))
+	if err != nil || backoffBase < 0 {
+		return nil, fmt.Errorf("invalid RETRY_BACKOFF_BASE: %q", configs.AppConfig.Get("RETRY_BACKOFF_BASE"))
+	}
+	backoffMax, err := time.ParseDuration(configs.AppConfig.GetOrDefault("RETRY_BACKOFF_MAX", "250ms"))
+	if err != nil || backoffMax < backoffBase {
+		return nil, fmt.Errorf("invalid RETRY_BACKOFF_MAX: %q", configs.AppConfig.Get("RETRY_BACKOFF_MAX"))
+	}
+	retryOn, err := parseStatusRanges(configs.AppConfig.GetOrDefault("RETRY_ON_STATUS", "502,503,504"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RETRY_ON_STATUS: %w", err)
+	}
+	maxBody, _ := strconv.ParseInt(configs.AppConfig.GetOrDefault("RETRY_MAX_BODY_BYTES", "1048576"), 10, 64)
+	budget, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("RETRY_BUDGET_PERCENT", "20"))
+	minRetries, _ := strconv.Atoi(configs.AppConfig.GetOrDefault("RETRY_MIN_CONCURRENCY", "3"))
+
+	return &RetryPolicy{
+		Attempts:            attempts,
+		PerTryTimeout:       perTry,
+		BackoffBase:         backoffBase,
+		BackoffMax:          backoffMax,
+		RetryOn:             retryOn,
+		MaxBodyBytes:        max(maxBody, 0),
+		BudgetPercent:       max(budget, 0),
+		MinRetryConcurrency: max(minRetries, 0),
+	}, nil
+}
+
+// isIdempotent reports whether the method is idempotent as defined by RFC 9110.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// upstreamAttempt carries what one try of a proxied request needs.
+type upstreamAttempt struct {
+	// body is the buffered request body replayed on every try, nil to stream
+	// the client's body straight to the upstream.
+	body []byte
+	// retry reports whether the outcome of the try should be thrown away and
+	// the request tried again; nil on the last try.
+	retry func(resp *http.Response, err error, sent bool) bool
+}
+
+// requestBody returns the body and content length to send upstream.
+func (a *upstreamAttempt) requestBody(c echo.Context) (io.Reader, int64) {
+	if a == nil || a.body == nil {
+		return c.Request().Body, c.Request().ContentLength
+	}
+	return bytes.NewReader(a.body), int64(len(a.body))
+}
+
+// proxyWithRetries forwards the request to target and, following the retry
+// policy, tries other targets from the balancer when it fails. done releases
+// the slot reserved on target; it is called early when the request moves on
+// to another target.
+func proxyWithRetries(c echo.Context, target *middleware.ProxyTarget, done func(), balancer Balancer) error {
+	if retryPolicy == nil {
+		return forwardRequestToTarget(c, target, nil)
+	}
+	return retryPolicy.proxy(c, target, done, balancer)
+}
+
+func (p *RetryPolicy) proxy(c echo.Context, target *middleware.ProxyTarget, done func(), balancer Balancer) error {
+	activeRequests.Add(1)
+	defer activeRequests.Add(-1)
+
+	attempt := &upstreamAttempt{}
+	canReplay, err := p.bufferBody(c, attempt)
+	if err != nil {
+		return err
+	}
+	idempotent := isIdempotent(c.Request().Method)
+
+	// A retry holds its slot of the retry budget until it has returned or
+	// handed the slot over to the next retry
+	held := false
+	release := func() {
+		if held {
+			activeRetries.Add(-1)
+			held = false
+		}
+	}
+	defer release()
+
+	tried := map[*middleware.ProxyTarget]bool{}
+	for try := 0; ; try++ {
+		tried[target] = true
+		last := try >= p.Attempts
+
+		retried := false
+		attempt.retry = nil
+		if !last {
+			attempt.retry = func(resp *http.Response, err error, sent bool) bool {
+				if !canReplay && sent {
+					return false
+				}
+				if err != nil {
+					if c.Request().Context().Err() != nil {
+						return false // the client went away
+					}
+					if !idempotent && sent {
+						return false
+					}
+				} else if !idempotent || !statusInRanges(resp.StatusCode, p.RetryOn) {
+					return false
+				}
+				release()
+				retried = p.acquireBudget()
+				held = retried
+				return retried
+			}
+		}
+
+		err := forwardRequestToTarget(c, target, attempt)
+		if !retried {
+			return err
+		}
+		done()
+		upstreamRetries.WithLabelValues(target.URL.String()).Inc()
+
+		if err := p.backoff(c.Request().Context(), try); err != nil {
+			return err
+		}
+		next, nextDone := p.nextTarget(c, balancer, tried)
+		if next == nil {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "no healthy upstream target")
+		}
+		defer nextDone()
+		target, done = next, nextDone
+	}
+}
+
+// bufferBody reads the request body into the attempt so it can be replayed.
+// Bodies over MaxBodyBytes are streamed instead and can only be retried when
+// they were never sent.
+func (p *RetryPolicy) bufferBody(c echo.Context, attempt *upstreamAttempt) (bool, error) {
+	req := c.Request()
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		attempt.body = []byte{}
+		return true, nil
+	}
+	if req.ContentLength > p.MaxBodyBytes {
+		return false, nil
+	}
+
+	buffered, err := io.ReadAll(io.LimitReader(req.Body, p.MaxBodyBytes+1))
+	if err != nil {
+		return false, fmt.Errorf("failed to read request body: %w", err)
+	}
+	if int64(len(buffered)) > p.MaxBodyBytes {
+		// Too big to buffer, stream what was read followed by the rest
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buffered), req.Body), req.Body}
+		return false, nil
+	}
+	attempt.body = buffered
+	return true, nil
+}
+
+// acquireBudget takes a slot from the retry budget, reporting whether the
+// retry may go ahead.
+func (p *RetryPolicy) acquireBudget() bool {
+	allowed := max(activeRequests.Load()*int64(p.BudgetPercent)/100, int64(p.MinRetryConcurrency))
+	if activeRetries.Add(1) > allowed {
+		activeRetries.Add(-1)
+		retryBudgetExhausted.Inc()
+		return false
+	}
+	return true
+}
+
+// backoff waits before the next try using exponential backoff with full jitter.
+func (p *RetryPolicy) backoff(ctx context.Context, try int) error {
+	if p.BackoffBase <= 0 {
+		return nil
+	}
+	ceiling := min(p.BackoffBase<<min(try, 16), p.BackoffMax)
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(ceiling) + 1)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// nextTarget picks the target for a retry, preferring ones not tried yet, and
+// reserves a slot on it. The returned function releases the slot.
+func (p *RetryPolicy) nextTarget(c echo.Context, balancer Balancer, tried map[*middleware.ProxyTarget]bool) (*middleware.ProxyTarget, func()) {
+	var fallback *middleware.ProxyTarget
+	fallbackDone := func() {}
+	for range 2*len(tried) + 1 {
+		target, done := pickTarget(balancer, c.Request())
+		if target == nil || !tried[target] {
+			fallbackDone()
+			return target, done
+		}
+		fallbackDone()
+		fallback, fallbackDone = target, done
+	}
+	return fallback, fallbackDone
+}
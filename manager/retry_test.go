@@ -0,0 +1,93 @@
+package manager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// resetRetryCounters clears the process wide request and retry counters
+// before and after a test.
+func resetRetryCounters(t *testing.T) {
+	activeRequests.Store(0)
+	activeRetries.Store(0)
+	t.Cleanup(func() {
+		activeRequests.Store(0)
+		activeRetries.Store(0)
+	})
+}
+
+func TestAcquireBudgetRefusesPastMinRetryConcurrency(t *testing.T) {
+	resetRetryCounters(t)
+	policy := &RetryPolicy{BudgetPercent: 20, MinRetryConcurrency: 3}
+
+	for i := range 3 {
+		if !policy.acquireBudget() {
+			t.Fatalf("retry %d refused with %d retries in flight", i+1, i)
+		}
+	}
+	if policy.acquireBudget() {
+		t.Fatal("fourth retry allowed with 3 retries in flight")
+	}
+	if got := activeRetries.Load(); got != 3 {
+		t.Fatalf("refused retry left %d retries counted, want 3", got)
+	}
+
+	activeRetries.Add(-1)
+	if !policy.acquireBudget() {
+		t.Fatal("retry refused after a slot was freed")
+	}
+}
+
+// fixedBalancer always picks the same target.
+type fixedBalancer struct {
+	target *middleware.ProxyTarget
+}
+
+func (b fixedBalancer) NextTarget(*http.Request) *middleware.ProxyTarget {
+	return b.target
+}
+
+func TestRetryHoldsBudgetWhileInFlight(t *testing.T) {
+	resetRetryCounters(t)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	var inFlight atomic.Int64
+	inFlight.Store(-1)
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Store(activeRetries.Load())
+		w.Write([]byte("ok"))
+	}))
+	defer healthy.Close()
+
+	targets, err := buildTargets([]helper.TargetSpec{{URL: failing.URL}, {URL: healthy.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retryOn, _ := parseStatusRanges("502")
+	policy := &RetryPolicy{Attempts: 1, RetryOn: retryOn, MaxBodyBytes: 1024, BudgetPercent: 20, MinRetryConcurrency: 1}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	if err := policy.proxy(c, targets[0], func() {}, fixedBalancer{targets[1]}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want the retried target's 200", rec.Code)
+	}
+	if got := inFlight.Load(); got != 1 {
+		t.Fatalf("retry counted %d retries in flight while it ran, want 1", got)
+	}
+	if got := activeRetries.Load(); got != 0 {
+		t.Fatalf("%d retries still counted after the request, want 0", got)
+	}
+}
@@ -0,0 +1,111 @@
+package manager
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/labstack/echo/v4"
+)
+
+// upstreamURIKey is the echo context key holding the rewritten request URI.
+const upstreamURIKey = "upstream_uri"
+
+// Rewrite is a compiled RewriteSpec of a route.
+type Rewrite struct {
+	StripPrefix string
+	Regex       *regexp.Regexp
+	Replacement string
+	AddPrefix   string
+	RemoveQuery []string
+	AddQuery    map[string]string
+}
+
+// newRewrite compiles the rewrite rules of a route, nil when it has none.
+func newRewrite(spec *helper.RewriteSpec) (*Rewrite, error) {
+	if spec == nil {
+		return nil, nil
+	}
+
+	rewrite := &Rewrite{
+		StripPrefix: spec.StripPrefix,
+		Replacement: spec.Replacement,
+		AddPrefix:   spec.AddPrefix,
+		RemoveQuery: spec.RemoveQuery,
+		AddQuery:    spec.AddQuery,
+	}
+	if spec.Regex != "" {
+		regex, err := regexp.Compile(spec.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite regex %q: %w", spec.Regex, err)
+		}
+		rewrite.Regex = regex
+	}
+	return rewrite, nil
+}
+
+// Apply returns the rewritten request URI (path and query) for u. The path
+// rules work on the escaped path, so encoded characters reach the upstream
+// unchanged.
+func (r *Rewrite) Apply(u *url.URL) string {
+	path := u.EscapedPath()
+	if r.StripPrefix != "" && hasPathPrefix(path, r.StripPrefix) {
+		path = path[len(r.StripPrefix):]
+	}
+	if r.Regex != nil {
+		path = r.Regex.ReplaceAllString(path, r.Replacement)
+	}
+	if r.AddPrefix != "" {
+		path = strings.TrimSuffix(r.AddPrefix, "/") + "/" + strings.TrimPrefix(path, "/")
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	query := u.RawQuery
+	if len(r.RemoveQuery) > 0 || len(r.AddQuery) > 0 {
+		query = r.editQuery(query)
+	}
+
+	if query == "" {
+		return path
+	}
+	return path + "?" + query
+}
+
+// editQuery drops the parameters the rule removes or sets from rawQuery and
+// appends the added ones in key order. The other parameters keep the order and
+// escaping the client sent them with.
+func (r *Rewrite) editQuery(rawQuery string) string {
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		key, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if _, added := r.AddQuery[key]; added || slices.Contains(r.RemoveQuery, key) {
+			continue
+		}
+		params = append(params, param)
+	}
+	for _, key := range slices.Sorted(maps.Keys(r.AddQuery)) {
+		params = append(params, url.QueryEscape(key)+"="+url.QueryEscape(r.AddQuery[key]))
+	}
+	return strings.Join(params, "&")
+}
+
+// upstreamURI returns the request URI to send upstream: the rewritten one when
+// the route rewrote it, the client's otherwise.
+func upstreamURI(c echo.Context) string {
+	if uri, ok := c.Get(upstreamURIKey).(string); ok {
+		return uri
+	}
+	return c.Request().RequestURI
+}
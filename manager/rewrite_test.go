@@ -0,0 +1,58 @@
+package manager
+
+import (
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+func TestRewriteApply(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		rewrite Rewrite
+		uri     string
+		want    string
+	}{
+		{"strip prefix", Rewrite{StripPrefix: "/api"}, "/api/users?id=1", "/users?id=1"},
+		{"strip whole path", Rewrite{StripPrefix: "/api"}, "/api", "/"},
+		{"strip stops at segment boundary", Rewrite{StripPrefix: "/api/orders"}, "/api/ordersfoo", "/api/ordersfoo"},
+		{"strip prefix ending in slash", Rewrite{StripPrefix: "/api/"}, "/api/users", "/users"},
+		{"add prefix", Rewrite{AddPrefix: "/v2/"}, "/users", "/v2/users"},
+		{"regex", Rewrite{Regex: regexp.MustCompile(`^/users/([0-9]+)$`), Replacement: "/v2/users/$1"}, "/users/42", "/v2/users/42"},
+		{"escaped path kept", Rewrite{StripPrefix: "/files"}, "/files/a%2Fb", "/a%2Fb"},
+		{"no query rule keeps raw query", Rewrite{StripPrefix: "/api"}, "/api/x?b=2&a=%7e", "/x?b=2&a=%7e"},
+		{"remove query", Rewrite{RemoveQuery: []string{"debug"}}, "/x?z=1&debug=on&a=%7e&debug", "/x?z=1&a=%7e"},
+		{"add query", Rewrite{AddQuery: map[string]string{"source": "proxy", "b": "a b"}}, "/x?z=1&source=client", "/x?z=1&b=a+b&source=proxy"},
+		{"add query to empty query", Rewrite{AddQuery: map[string]string{"source": "proxy"}}, "/x", "/x?source=proxy"},
+		{"remove last parameter", Rewrite{RemoveQuery: []string{"debug"}}, "/x?debug=1", "/x"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			u, err := url.ParseRequestURI(test.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := test.rewrite.Apply(u); got != test.want {
+				t.Fatalf("Apply(%q) = %q, want %q", test.uri, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRoutePathPrefixMatchesWholeSegments(t *testing.T) {
+	for _, test := range []struct {
+		prefix, path string
+		want         bool
+	}{
+		{"/api/orders", "/api/orders", true},
+		{"/api/orders", "/api/orders/7", true},
+		{"/api/orders", "/api/ordersfoo", false},
+		{"/api/", "/api/orders", true},
+		{"/api/", "/apis", false},
+		{"/", "/anything", true},
+	} {
+		route := &Route{PathPrefix: test.prefix}
+		if got := route.matches(test.path); got != test.want {
+			t.Errorf("prefix %q matches %q = %v, want %v", test.prefix, test.path, got, test.want)
+		}
+	}
+}
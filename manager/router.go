@@ -0,0 +1,313 @@
+package manager
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// defaultPoolName is the name of the pool built from the top level "targets".
+const defaultPoolName = "default"
+
+// Route sends matching requests to an upstream pool, or splits them across
+// several pools by weight.
+type Route struct {
+	PathPrefix string
+	PathRegex  *regexp.Regexp
+	PoolName   string
+	Pool       *Pool
+	Split      []*SplitPool
+	Overrides  []*Override
+	Rewrite    *Rewrite
+	Mirror     *Mirror
+	HostPolicy *HostPolicy
+	// WebSocketAuth checks WebSocket upgrades before they are relayed
+	WebSocketAuth *ForwardAuth
+
+	splitTotal int
+}
+
+// matches reports whether the request path matches the route.
+func (r *Route) matches(path string) bool {
+	if r.PathPrefix != "" && !hasPathPrefix(path, r.PathPrefix) {
+		return false
+	}
+	if r.PathRegex != nil && !r.PathRegex.MatchString(path) {
+		return false
+	}
+	return true
+}
+
+// hasPathPrefix reports whether path is prefix or lies below it, so "/api"
+// matches "/api" and "/api/users" but not "/apis".
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// VirtualHost holds the routes of a set of host names.
+type VirtualHost struct {
+	Hosts  []string
+	Routes []*Route
+}
+
+// matches reports whether the host name is served by the virtual host.
+func (v *VirtualHost) matches(host string) bool {
+	for _, pattern := range v.Hosts {
+		switch {
+		case pattern == "*":
+			return true
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		case pattern == host:
+			return true
+		}
+	}
+	return false
+}
+
+// Router is the routing table of the proxy. Requests are matched against the
+// virtual hosts in order and then against the routes of the first matching
+// host, in order. Requests for hosts without a virtual host go to the default
+// pool.
+type Router struct {
+	VirtualHosts []*VirtualHost
+	Pools        map[string]*Pool
+	Default      *Route
+	TCPRoutes    []*TCPRoute
+}
+
+// NewRouter builds the pools and the routing table from targets.json.
+func NewRouter(spec helper.Target) (*Router, error) {
+	router := &Router{Pools: map[string]*Pool{}}
+
+	if len(spec.Targets) > 0 || len(spec.Pools) == 0 {
+		targets, err := buildTargets(spec.Targets)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := NewPool(defaultPoolName, balancerStrategy(), targets)
+		if err != nil {
+			return nil, err
+		}
+		if pool.TCP, err = isTCPPool(targets); err != nil {
+			return nil, err
+		}
+		router.Pools[defaultPoolName] = pool
+		if !pool.TCP {
+			router.Default = &Route{PoolName: defaultPoolName, Pool: pool}
+		}
+	}
+
+	for name, poolSpec := range spec.Pools {
+		if _, exists := router.Pools[name]; exists {
+			return nil, fmt.Errorf("duplicate pool %q", name)
+		}
+		targets, err := buildTargets(poolSpec.Targets)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: %w", name, err)
+		}
+		strategy := poolSpec.Strategy
+		if strategy == "" {
+			strategy = balancerStrategy()
+		}
+		pool, err := NewPool(name, strategy, targets)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: %w", name, err)
+		}
+		if pool.TCP, err = isTCPPool(targets); err != nil {
+			return nil, fmt.Errorf("pool %q: %w", name, err)
+		}
+		router.Pools[name] = pool
+	}
+
+	for _, hostSpec := range spec.VirtualHosts {
+		if len(hostSpec.Hosts) == 0 {
+			return nil, fmt.Errorf("virtual host without hosts")
+		}
+		vhost := &VirtualHost{}
+		for _, host := range hostSpec.Hosts {
+			vhost.Hosts = append(vhost.Hosts, strings.ToLower(host))
+		}
+		for _, routeSpec := range hostSpec.Routes {
+			route, err := router.buildRoute(routeSpec)
+			if err != nil {
+				return nil, fmt.Errorf("virtual host %v: %w", hostSpec.Hosts, err)
+			}
+			vhost.Routes = append(vhost.Routes, route)
+		}
+		router.VirtualHosts = append(router.VirtualHosts, vhost)
+	}
+
+	for _, listenerSpec := range spec.TCPListeners {
+		tcpRoute, err := router.buildTCPRoute(listenerSpec)
+		if err != nil {
+			return nil, fmt.Errorf("tcp listener %q: %w", listenerSpec.Listen, err)
+		}
+		router.TCPRoutes = append(router.TCPRoutes, tcpRoute)
+	}
+	return router, nil
+}
+
+func (r *Router) buildRoute(spec helper.RouteSpec) (*Route, error) {
+	route := &Route{PathPrefix: spec.PathPrefix, PoolName: spec.Pool}
+	if spec.Pool != "" || len(spec.Split) == 0 {
+		pool, ok := r.Pools[spec.Pool]
+		if !ok {
+			return nil, fmt.Errorf("route to unknown pool %q", spec.Pool)
+		}
+		route.Pool = pool
+	}
+	if err := r.buildSplit(route, spec); err != nil {
+		return nil, err
+	}
+	if spec.PathRegex != "" {
+		regex, err := regexp.Compile(spec.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path_regex %q: %w", spec.PathRegex, err)
+		}
+		route.PathRegex = regex
+	}
+	rewrite, err := newRewrite(spec.Rewrite)
+	if err != nil {
+		return nil, err
+	}
+	route.Rewrite = rewrite
+	mirror, err := r.buildMirror(spec.Mirror)
+	if err != nil {
+		return nil, err
+	}
+	route.Mirror = mirror
+	hostPolicy, err := newHostPolicy(spec.HostPolicy, spec.Host)
+	if err != nil {
+		return nil, err
+	}
+	route.HostPolicy = hostPolicy
+	auth, err := newForwardAuth(spec.WebSocketAuth)
+	if err != nil {
+		return nil, err
+	}
+	route.WebSocketAuth = auth
+
+	// Pools of raw TCP targets only serve the TCP listeners
+	names := []string{spec.Pool}
+	for _, split := range spec.Split {
+		names = append(names, split.Pool)
+	}
+	for _, override := range spec.Overrides {
+		names = append(names, override.Pool)
+	}
+	if spec.Mirror != nil {
+		names = append(names, spec.Mirror.Pool)
+	}
+	for _, name := range names {
+		if pool := r.Pools[name]; pool != nil && pool.TCP {
+			return nil, fmt.Errorf("route to tcp pool %q", name)
+		}
+	}
+	return route, nil
+}
+
+// Match returns the route of the request, nil when no route matches.
+func (r *Router) Match(req *http.Request) *Route {
+	host := requestHost(req)
+	for _, vhost := range r.VirtualHosts {
+		if !vhost.matches(host) {
+			continue
+		}
+		for _, route := range vhost.Routes {
+			if route.matches(req.URL.Path) {
+				return route
+			}
+		}
+		return nil
+	}
+	return r.Default
+}
+
+// Targets returns the targets of every pool, each URL listed once.
+func (r *Router) Targets() []*middleware.ProxyTarget {
+	var targets []*middleware.ProxyTarget
+	seen := map[string]bool{}
+	for _, pool := range r.Pools {
+		for _, target := range pool.Targets() {
+			if !seen[target.URL.String()] {
+				seen[target.URL.String()] = true
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets
+}
+
+// requestHost returns the lower cased host name of the request without the
+// port, taken from the Host header or, when that is empty, the TLS SNI.
+func requestHost(req *http.Request) string {
+	host := req.Host
+	if host == "" && req.TLS != nil {
+		host = req.TLS.ServerName
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return strings.ToLower(host)
+}
+
+// RouteTable holds the running router; reloads swap in a new one atomically
+// while requests in flight keep the route they matched.
+type RouteTable struct {
+	current atomic.Pointer[Router]
+}
+
+// NewRouteTable builds a route table from targets.json.
+func NewRouteTable(spec helper.Target) (*RouteTable, error) {
+	table := &RouteTable{}
+	if err := table.Load(spec); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// Router returns the running router.
+func (t *RouteTable) Router() *Router {
+	return t.current.Load()
+}
+
+// Load validates spec and swaps it in as the running router.
+func (t *RouteTable) Load(spec helper.Target) error {
+	router, err := NewRouter(spec)
+	if err != nil {
+		return err
+	}
+	t.current.Store(router)
+	return nil
+}
+
+// Match returns the route of the request in the running router.
+func (t *RouteTable) Match(req *http.Request) *Route {
+	return t.Router().Match(req)
+}
+
+// Pools returns every pool of the running router.
+func (t *RouteTable) Pools() []*Pool {
+	var pools []*Pool
+	for _, pool := range t.Router().Pools {
+		pools = append(pools, pool)
+	}
+	return pools
+}
+
+// Targets returns the targets of every pool of the running router.
+func (t *RouteTable) Targets() []*middleware.ProxyTarget {
+	return t.Router().Targets()
+}
@@ -0,0 +1,116 @@
+package manager
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+)
+
+// SplitPool is one pool of a route's traffic split.
+type SplitPool struct {
+	PoolName string
+	Pool     *Pool
+	Weight   int
+}
+
+// Override forces a pool for requests whose header, cookie or query parameter
+// matches.
+type Override struct {
+	Header string
+	Cookie string
+	Query  string
+	Value  string
+	Pool   *Pool
+}
+
+// matches reports whether the request carries the override's value.
+func (o *Override) matches(req *http.Request) bool {
+	var value string
+	var found bool
+	switch {
+	case o.Header != "":
+		values := req.Header.Values(o.Header)
+		found = len(values) > 0
+		if found {
+			value = values[0]
+		}
+	case o.Cookie != "":
+		cookie, err := req.Cookie(o.Cookie)
+		found = err == nil
+		if found {
+			value = cookie.Value
+		}
+	case o.Query != "":
+		values, ok := req.URL.Query()[o.Query]
+		found = ok
+		if found && len(values) > 0 {
+			value = values[0]
+		}
+	}
+	return found && (o.Value == "" || value == o.Value)
+}
+
+// buildSplit resolves the pools of a route's weighted split and overrides.
+func (r *Router) buildSplit(route *Route, spec helper.RouteSpec) error {
+	for _, splitSpec := range spec.Split {
+		pool, ok := r.Pools[splitSpec.Pool]
+		if !ok {
+			return fmt.Errorf("split to unknown pool %q", splitSpec.Pool)
+		}
+		if splitSpec.Weight < 0 {
+			return fmt.Errorf("invalid split weight %d for pool %q", splitSpec.Weight, splitSpec.Pool)
+		}
+		route.Split = append(route.Split, &SplitPool{PoolName: splitSpec.Pool, Pool: pool, Weight: splitSpec.Weight})
+		route.splitTotal += splitSpec.Weight
+	}
+	if len(spec.Split) > 0 && route.splitTotal == 0 {
+		return fmt.Errorf("split without any weight")
+	}
+
+	for _, overrideSpec := range spec.Overrides {
+		pool, ok := r.Pools[overrideSpec.Pool]
+		if !ok {
+			return fmt.Errorf("override to unknown pool %q", overrideSpec.Pool)
+		}
+		set := 0
+		for _, name := range []string{overrideSpec.Header, overrideSpec.Cookie, overrideSpec.Query} {
+			if name != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("override to pool %q needs exactly one of header, cookie or query", overrideSpec.Pool)
+		}
+		route.Overrides = append(route.Overrides, &Override{
+			Header: overrideSpec.Header,
+			Cookie: overrideSpec.Cookie,
+			Query:  overrideSpec.Query,
+			Value:  overrideSpec.Value,
+			Pool:   pool,
+		})
+	}
+	return nil
+}
+
+// Select returns the pool serving the request: the pool of the first matching
+// override, otherwise a pool of the split picked at random by weight, otherwise
+// the route's pool.
+func (r *Route) Select(req *http.Request) *Pool {
+	for _, override := range r.Overrides {
+		if override.matches(req) {
+			return override.Pool
+		}
+	}
+	if r.splitTotal > 0 {
+		n := rand.Intn(r.splitTotal)
+		for _, split := range r.Split {
+			if n < split.Weight {
+				return split.Pool
+			}
+			n -= split.Weight
+		}
+	}
+	return r.Pool
+}
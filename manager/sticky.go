@@ -0,0 +1,185 @@
+package manager
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// StickySessions pins a client to the target that served its first request
+// using a signed affinity cookie. The cookie carries one pin per pool, the
+// opaque ids of the pool and of the target with its expiry, so switching
+// between routes or split pools keeps the pins of the other pools. It is
+// signed with HMAC-SHA256 so clients can neither forge nor extend it.
+type StickySessions struct {
+	CookieName string
+	TTL        time.Duration
+	Secure     bool
+	key        []byte
+}
+
+// newStickySessions reads the sticky session settings, returning nil when
+// STICKY_SESSIONS is not turned on.
+func newStickySessions() (*StickySessions, error) {
+	if configs.AppConfig.GetOrDefault("STICKY_SESSIONS", "off") != "on" {
+		return nil, nil
+	}
+
+	ttl, err := time.ParseDuration(configs.AppConfig.GetOrDefault("STICKY_COOKIE_TTL", "1h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid STICKY_COOKIE_TTL: %w", err)
+	}
+
+	key := []byte(configs.AppConfig.Get("STICKY_SIGNING_KEY"))
+	if len(key) == 0 {
+		// Without a shared key the cookies are only valid for this process
+		fmt.Println("WARNING: STICKY_SIGNING_KEY is not set, using a random key for this run")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate sticky session key: %w", err)
+		}
+	}
+
+	return &StickySessions{
+		CookieName: configs.AppConfig.GetOrDefault("STICKY_COOKIE_NAME", "blue_proxy_affinity"),
+		TTL:        ttl,
+		Secure:     proxy_tls == "on",
+		key:        key,
+	}, nil
+}
+
+// maxStickyPools bounds the pins kept in one affinity cookie; the ones
+// expiring first are dropped.
+const maxStickyPools = 16
+
+// stickyPin is the target a client is pinned to in one pool.
+type stickyPin struct {
+	target  string
+	expires int64 // unix seconds
+}
+
+// NextTarget returns the target the request's affinity cookie pins in the
+// pool when it is still there and available, with a slot reserved on it.
+// Otherwise it picks a target through the pool's balancer and pins it in the
+// cookie next to the other pools. The returned function releases the slot.
+func (s *StickySessions) NextTarget(c echo.Context, pool *Pool) (*middleware.ProxyTarget, func()) {
+	pins := map[string]stickyPin{}
+	if cookie, err := c.Cookie(s.CookieName); err == nil {
+		if verified, ok := s.verify(cookie.Value); ok {
+			pins = verified
+		}
+	}
+
+	key := poolID(pool)
+	if pin, ok := pins[key]; ok {
+		for _, target := range pool.Targets() {
+			if targetID(target) == pin.target && isAvailable(target) {
+				if release, ok := reserve(target); ok {
+					return target, release
+				}
+			}
+		}
+	}
+
+	target, release := pickTarget(pool.Balancer(), c.Request())
+	if target != nil {
+		pins[key] = stickyPin{target: targetID(target), expires: time.Now().Add(s.TTL).Unix()}
+		c.SetCookie(s.cookie(pins))
+	}
+	return target, release
+}
+
+// cookie encodes the pins as "pool.target.expiry" entries joined by "~",
+// followed by the signature of them all.
+func (s *StickySessions) cookie(pins map[string]stickyPin) *http.Cookie {
+	keys := make([]string, 0, len(pins))
+	for key := range pins {
+		keys = append(keys, key)
+	}
+	// Keep the pins expiring last, in a stable order
+	sort.Slice(keys, func(i, j int) bool {
+		if pins[keys[i]].expires != pins[keys[j]].expires {
+			return pins[keys[i]].expires > pins[keys[j]].expires
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > maxStickyPools {
+		keys = keys[:maxStickyPools]
+	}
+
+	entries := make([]string, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, key+"."+pins[key].target+"."+strconv.FormatInt(pins[key].expires, 10))
+	}
+	payload := strings.Join(entries, "~")
+
+	expires := time.Unix(pins[keys[0]].expires, 0)
+	return &http.Cookie{
+		Name:     s.CookieName,
+		Value:    payload + "." + s.sign(payload),
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(time.Until(expires).Seconds()),
+		Secure:   s.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// verify checks the signature of a cookie value and returns the pins it
+// carries that have not expired yet, keyed by pool id.
+func (s *StickySessions) verify(value string) (map[string]stickyPin, bool) {
+	index := strings.LastIndex(value, ".")
+	if index < 0 {
+		return nil, false
+	}
+	payload, signature := value[:index], value[index+1:]
+	if !hmac.Equal([]byte(signature), []byte(s.sign(payload))) {
+		return nil, false
+	}
+
+	now := time.Now().Unix()
+	pins := map[string]stickyPin{}
+	for _, entry := range strings.Split(payload, "~") {
+		fields := strings.Split(entry, ".")
+		if len(fields) != 3 {
+			return nil, false
+		}
+		unix, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		if now <= unix {
+			pins[fields[0]] = stickyPin{target: fields[1], expires: unix}
+		}
+	}
+	return pins, true
+}
+
+func (s *StickySessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// targetID is the opaque name of a target used in affinity cookies, so the
+// backend addresses are not exposed to clients.
+func targetID(target *middleware.ProxyTarget) string {
+	return strconv.FormatUint(hashString(target.URL.String()), 36)
+}
+
+// poolID is the opaque name of a pool used in affinity cookies.
+func poolID(pool *Pool) string {
+	return strconv.FormatUint(hashString(pool.Name), 36)
+}
@@ -0,0 +1,121 @@
+package manager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+func testPool(t *testing.T, name string, urls ...string) *Pool {
+	t.Helper()
+	var specs []helper.TargetSpec
+	for _, url := range urls {
+		specs = append(specs, helper.TargetSpec{URL: url})
+	}
+	pool, err := NewPool(name, roundRobinStrategy, testTargets(t, specs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// stickyRequest picks a target of the pool for a client sending cookie and
+// returns it with the affinity cookie set in the response, if any.
+func stickyRequest(s *StickySessions, pool *Pool, cookie *http.Cookie) (*middleware.ProxyTarget, *http.Cookie) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	target, release := s.NextTarget(echo.New().NewContext(req, rec), pool)
+	release()
+	for _, set := range rec.Result().Cookies() {
+		if set.Name == s.CookieName {
+			return target, set
+		}
+	}
+	return target, cookie
+}
+
+func TestStickySessionsKeepPinsOfOtherPools(t *testing.T) {
+	sticky := &StickySessions{CookieName: "affinity", TTL: time.Hour, key: []byte("test key")}
+	api := testPool(t, "api", "http://api-1:80", "http://api-2:80")
+	web := testPool(t, "web", "http://web-1:80", "http://web-2:80")
+
+	apiTarget, cookie := stickyRequest(sticky, api, nil)
+	webTarget, cookie := stickyRequest(sticky, web, cookie)
+
+	// Alternate between the pools; each must keep returning to its pin
+	for range 4 {
+		var target *middleware.ProxyTarget
+		if target, cookie = stickyRequest(sticky, api, cookie); target != apiTarget {
+			t.Fatalf("api request went to %s, pinned to %s", target.URL, apiTarget.URL)
+		}
+		if target, cookie = stickyRequest(sticky, web, cookie); target != webTarget {
+			t.Fatalf("web request went to %s, pinned to %s", target.URL, webTarget.URL)
+		}
+	}
+}
+
+func TestStickySessionsRejectTamperedCookie(t *testing.T) {
+	sticky := &StickySessions{CookieName: "affinity", TTL: time.Hour, key: []byte("test key")}
+	pool := testPool(t, "api", "http://api-1:80", "http://api-2:80")
+
+	_, cookie := stickyRequest(sticky, pool, nil)
+	pins, ok := sticky.verify(cookie.Value)
+	if !ok || len(pins) != 1 {
+		t.Fatalf("own cookie not accepted: %v %v", pins, ok)
+	}
+	if _, ok := sticky.verify("x" + cookie.Value); ok {
+		t.Fatal("tampered cookie accepted")
+	}
+}
+
+func TestStickySessionsVerifySignatureAndExpiry(t *testing.T) {
+	sticky := &StickySessions{CookieName: "affinity", TTL: time.Hour, key: []byte("test key")}
+	pins := map[string]stickyPin{
+		"live": {target: "a", expires: time.Now().Add(time.Hour).Unix()},
+		"old":  {target: "b", expires: time.Now().Add(-time.Minute).Unix()},
+	}
+	value := sticky.cookie(pins).Value
+
+	verified, ok := sticky.verify(value)
+	if !ok {
+		t.Fatal("own cookie not accepted")
+	}
+	if _, ok := verified["old"]; ok || verified["live"].target != "a" {
+		t.Fatalf("verified pins %v, want only the unexpired one", verified)
+	}
+
+	other := &StickySessions{CookieName: "affinity", TTL: time.Hour, key: []byte("other key")}
+	if _, ok := other.verify(value); ok {
+		t.Fatal("cookie signed with another key accepted")
+	}
+}
+
+func TestStickySessionsFallBackFromUnhealthyPin(t *testing.T) {
+	sticky := &StickySessions{CookieName: "affinity", TTL: time.Hour, key: []byte("test key")}
+	pool := testPool(t, "api", "http://sticky-1:80", "http://sticky-2:80")
+
+	pinned, cookie := stickyRequest(sticky, pool, nil)
+	stateOf(pinned).healthy.Store(false)
+
+	target, repinned := stickyRequest(sticky, pool, cookie)
+	if target == pinned {
+		t.Fatal("request sent to the unhealthy pinned target")
+	}
+	if repinned == cookie {
+		t.Fatal("cookie not updated with the new pin")
+	}
+
+	// The new pin holds once the old target is healthy again
+	stateOf(pinned).healthy.Store(true)
+	if again, _ := stickyRequest(sticky, pool, repinned); again != target {
+		t.Fatalf("request went to %s, pinned to %s", again.URL, target.URL)
+	}
+}
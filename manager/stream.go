@@ -0,0 +1,157 @@
+package manager
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/labstack/echo/v4"
+)
+
+// copyBufferPool holds the buffers response bodies are copied through, so a
+// busy proxy does not allocate a fresh buffer per request.
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
+// flushIntervalSetting is how often buffered response data is flushed to the
+// client: 0 leaves it to the server, a negative value flushes after every write.
+var flushIntervalSetting = sync.OnceValue(func() time.Duration {
+	interval, err := time.ParseDuration(configs.AppConfig.GetOrDefault("FLUSH_INTERVAL", "0s"))
+	if err != nil {
+		fmt.Printf("WARNING: invalid FLUSH_INTERVAL, using 0s\n")
+		return 0
+	}
+	return interval
+})
+
+// flushInterval returns the flush interval for the response. Server-sent
+// events and responses of unknown length (chunked streams) are flushed as soon
+// as data arrives so they reach the client while they are still running.
+func flushInterval(resp *http.Response) time.Duration {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" || resp.ContentLength == -1 {
+		return -1
+	}
+	return flushIntervalSetting()
+}
+
+// copyResponse writes the upstream response to the client without its
+// hop-by-hop headers, streaming the body through a pooled buffer and
+// forwarding the trailers once the body is read.
+func copyResponse(c echo.Context, resp *http.Response) error {
+	res := c.Response()
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			res.Header().Add(key, value)
+		}
+	}
+
+	// Announce the trailers so they can be sent after the body
+	announced := len(resp.Trailer)
+	if announced > 0 {
+		keys := make([]string, 0, announced)
+		for key := range resp.Trailer {
+			keys = append(keys, key)
+		}
+		res.Header().Add("Trailer", strings.Join(keys, ", "))
+	}
+
+	res.WriteHeader(resp.StatusCode)
+
+	interval := flushInterval(resp)
+	if interval < 0 {
+		// Let the client see the headers of a stream before its first event
+		res.Flush()
+	}
+
+	var dst io.Writer = res
+	if interval != 0 {
+		latency := &maxLatencyWriter{dst: res, latency: interval}
+		defer latency.stop()
+		dst = latency
+	}
+
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+	// Hide any ReaderFrom/WriterTo so the copy goes through the pooled buffer
+	if _, err := io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{resp.Body}, *buf); err != nil {
+		return fmt.Errorf("failed to stream response body: %w", err)
+	}
+
+	// The trailers are only known once the body has been read to the end
+	if len(resp.Trailer) == announced {
+		for key, values := range resp.Trailer {
+			for _, value := range values {
+				res.Header().Add(key, value)
+			}
+		}
+	} else {
+		for key, values := range resp.Trailer {
+			for _, value := range values {
+				res.Header().Add(http.TrailerPrefix+key, value)
+			}
+		}
+	}
+	return nil
+}
+
+// maxLatencyWriter flushes what was written to dst after every write when
+// latency is negative, otherwise at most latency after the first unflushed
+// write.
+type maxLatencyWriter struct {
+	dst     *echo.Response
+	latency time.Duration
+
+	mu           sync.Mutex // guards dst, t and flushPending
+	t            *time.Timer
+	flushPending bool
+}
+
+func (m *maxLatencyWriter) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.dst.Write(p)
+	if m.latency < 0 {
+		m.dst.Flush()
+		return n, err
+	}
+	if m.flushPending {
+		return n, err
+	}
+	if m.t == nil {
+		m.t = time.AfterFunc(m.latency, m.delayedFlush)
+	} else {
+		m.t.Reset(m.latency)
+	}
+	m.flushPending = true
+	return n, err
+}
+
+func (m *maxLatencyWriter) delayedFlush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.flushPending { // stop was called after the timer fired
+		return
+	}
+	m.dst.Flush()
+	m.flushPending = false
+}
+
+func (m *maxLatencyWriter) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flushPending = false
+	if m.t != nil {
+		m.t.Stop()
+	}
+}
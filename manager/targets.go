@@ -0,0 +1,173 @@
+package manager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// buildTargets validates the targets.json entries and turns them into proxy
+// targets. Settings that need parsing, such as the TLS configuration and the
+// health check overrides, are prepared here and kept in the target's Meta so
+// a bad entry is rejected when the file is loaded rather than per request.
+func buildTargets(specs []helper.TargetSpec) ([]*middleware.ProxyTarget, error) {
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no targets to proxy to")
+	}
+
+	var urls []*middleware.ProxyTarget
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		url, err := url.Parse(spec.URL)
+		if err != nil {
+			return nil, err
+		}
+		if url.Scheme != "http" && url.Scheme != "https" && url.Scheme != "tcp" {
+			return nil, fmt.Errorf("invalid target URL scheme: %s", url.Scheme)
+		}
+		if spec.Weight < 0 {
+			return nil, fmt.Errorf("invalid weight %d for target %s", spec.Weight, spec.URL)
+		}
+		if spec.MaxConnections < 0 {
+			return nil, fmt.Errorf("invalid max_connections %d for target %s", spec.MaxConnections, spec.URL)
+		}
+		if seen[url.String()] {
+			return nil, fmt.Errorf("duplicate target %s", spec.URL)
+		}
+		seen[url.String()] = true
+
+		tlsConfig, err := buildTLSConfig(url, spec.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls settings for target %s: %w", spec.URL, err)
+		}
+		health, err := parseHealthOverride(spec.HealthCheck)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health_check for target %s: %w", spec.URL, err)
+		}
+		hostPolicy, err := newHostPolicy(spec.HostPolicy, spec.Host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host_policy for target %s: %w", spec.URL, err)
+		}
+
+		// Targets kept by a reload keep their transports and pooled connections
+		transports := transportsFor(transportKey(url, spec.TLS), tlsConfig)
+		meta := echo.Map{
+			"spec":           spec,
+			"tls":            transports.tls,
+			"health":         health,
+			"transport":      transports.transport,
+			"sni_transports": transports.serverNames,
+		}
+		if hostPolicy != nil {
+			meta["host"] = hostPolicy
+		}
+
+		urls = append(urls, &middleware.ProxyTarget{
+			Name: spec.URL,
+			URL:  url,
+			Meta: meta,
+		})
+	}
+	return urls, nil
+}
+
+// buildTLSConfig creates the client TLS configuration used to reach a target.
+func buildTLSConfig(target *url.URL, spec *helper.TLSSpec) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         target.Hostname(),
+		InsecureSkipVerify: true,
+	}
+	if spec == nil {
+		return config, nil
+	}
+
+	if spec.InsecureSkipVerify != nil {
+		config.InsecureSkipVerify = *spec.InsecureSkipVerify
+	}
+	if spec.ServerName != "" {
+		config.ServerName = spec.ServerName
+	}
+	if spec.CAFile != "" {
+		pem, err := os.ReadFile(spec.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", spec.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if spec.CertFile != "" || spec.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(spec.CertFile, spec.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// healthOverride is a parsed HealthCheckSpec; zero fields keep the global value.
+type healthOverride struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	ExpectedStatus     []statusRange
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+func parseHealthOverride(spec *helper.HealthCheckSpec) (*healthOverride, error) {
+	if spec == nil {
+		return nil, nil
+	}
+
+	if spec.Path != "" && !strings.HasPrefix(spec.Path, "/") {
+		return nil, fmt.Errorf("invalid path %q, must start with /", spec.Path)
+	}
+	override := &healthOverride{
+		Path:               spec.Path,
+		HealthyThreshold:   spec.HealthyThreshold,
+		UnhealthyThreshold: spec.UnhealthyThreshold,
+	}
+	var err error
+	if spec.Interval != "" {
+		if override.Interval, err = time.ParseDuration(spec.Interval); err != nil || override.Interval <= 0 {
+			return nil, fmt.Errorf("invalid interval %q", spec.Interval)
+		}
+	}
+	if spec.Timeout != "" {
+		if override.Timeout, err = time.ParseDuration(spec.Timeout); err != nil || override.Timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", spec.Timeout)
+		}
+	}
+	if spec.ExpectedStatus != "" {
+		if override.ExpectedStatus, err = parseStatusRanges(spec.ExpectedStatus); err != nil {
+			return nil, err
+		}
+	}
+	return override, nil
+}
+
+// targetTLSConfig returns the client TLS configuration of the target.
+func targetTLSConfig(target *middleware.ProxyTarget) *tls.Config {
+	if config, ok := target.Meta["tls"].(*tls.Config); ok {
+		return config
+	}
+	return &tls.Config{ServerName: target.URL.Hostname(), InsecureSkipVerify: true}
+}
+
+// targetHealthOverride returns the target's health check overrides, if any.
+func targetHealthOverride(target *middleware.ProxyTarget) *healthOverride {
+	override, _ := target.Meta["health"].(*healthOverride)
+	return override
+}
@@ -0,0 +1,258 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TCPRoute relays the connections accepted on a listen address to a pool of
+// raw TCP targets.
+type TCPRoute struct {
+	Listen      string
+	PoolName    string
+	IdleTimeout time.Duration // 0 never closes quiet connections
+}
+
+// isTCPPool reports whether the targets are raw TCP endpoints. A pool cannot
+// mix them with HTTP targets.
+func isTCPPool(targets []*middleware.ProxyTarget) (bool, error) {
+	tcp := 0
+	for _, target := range targets {
+		if target.URL.Scheme != "tcp" {
+			continue
+		}
+		if target.URL.Port() == "" {
+			return false, fmt.Errorf("tcp target %s has no port", target.URL)
+		}
+		tcp++
+	}
+	if tcp > 0 && tcp < len(targets) {
+		return false, fmt.Errorf("pool mixes tcp and http targets")
+	}
+	return tcp > 0, nil
+}
+
+// buildTCPRoute checks a tcp_listeners entry against the pools.
+func (r *Router) buildTCPRoute(spec helper.TCPListenerSpec) (*TCPRoute, error) {
+	if _, _, err := net.SplitHostPort(spec.Listen); err != nil {
+		return nil, fmt.Errorf("invalid listen address: %w", err)
+	}
+	pool, ok := r.Pools[spec.Pool]
+	if !ok {
+		return nil, fmt.Errorf("unknown pool %q", spec.Pool)
+	}
+	if !pool.TCP {
+		return nil, fmt.Errorf("pool %q has no tcp targets", spec.Pool)
+	}
+
+	value := spec.IdleTimeout
+	if value == "" {
+		value = configs.AppConfig.GetOrDefault("TCP_IDLE_TIMEOUT", "1h")
+	}
+	idle, err := time.ParseDuration(value)
+	if err != nil || idle < 0 {
+		return nil, fmt.Errorf("invalid idle timeout %q", value)
+	}
+	return &TCPRoute{Listen: spec.Listen, PoolName: spec.Pool, IdleTimeout: idle}, nil
+}
+
+// TCPListener accepts raw TCP connections and relays each one to a target of
+// its pool, picked by the pool's balancer. The pool is looked up in the
+// running router for every connection, so reloaded targets apply to new
+// connections; changes to the listeners themselves need a restart.
+type TCPListener struct {
+	Route  *TCPRoute
+	Routes *RouteTable
+
+	listener net.Listener
+	once     sync.Once
+}
+
+// NewTCPListener creates a listener for the TCP route.
+func NewTCPListener(route *TCPRoute, routes *RouteTable) *TCPListener {
+	return &TCPListener{Route: route, Routes: routes}
+}
+
+// Start listens on the route's address and serves connections in the
+// background until Stop is called.
+func (l *TCPListener) Start() error {
+	listener, err := net.Listen("tcp", l.Route.Listen)
+	if err != nil {
+		return fmt.Errorf("tcp listener %s: %w", l.Route.Listen, err)
+	}
+	l.listener = listener
+	fmt.Printf("INFO: tcp listener on %s for pool %q\n", l.Route.Listen, l.Route.PoolName)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					time.Sleep(10 * time.Millisecond)
+					continue
+				}
+				fmt.Printf("WARNING: tcp listener on %s stopped: %v\n", l.Route.Listen, err)
+				return
+			}
+			go l.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Stop closes the listener. Connections already relayed are left open until
+// either side closes them or the process exits.
+func (l *TCPListener) Stop() {
+	l.once.Do(func() {
+		if l.listener != nil {
+			l.listener.Close()
+		}
+	})
+}
+
+// serve relays one client connection.
+func (l *TCPListener) serve(client net.Conn) {
+	defer client.Close()
+
+	pool, ok := l.Routes.Router().Pools[l.Route.PoolName]
+	if !ok || !pool.TCP {
+		tcpDropped.WithLabelValues(l.Route.Listen, "no_pool").Inc()
+		fmt.Printf("WARNING: tcp listener on %s: pool %q is gone\n", l.Route.Listen, l.Route.PoolName)
+		return
+	}
+	target, upstream, done := l.connect(pool, client)
+	if upstream == nil {
+		return
+	}
+	defer upstream.Close()
+	defer done()
+
+	name := target.URL.String()
+	tcpConnections.WithLabelValues(l.Route.Listen, name).Inc()
+	defer tcpConnections.WithLabelValues(l.Route.Listen, name).Dec()
+
+	s := &tcpSession{idleTimeout: l.Route.IdleTimeout}
+	s.lastActivity.Store(time.Now().UnixNano())
+	errs := make(chan error, 2)
+	go func() {
+		errs <- s.pipe(upstream, client, tcpBytes.WithLabelValues(l.Route.Listen, name, "upstream"))
+	}()
+	go func() {
+		errs <- s.pipe(client, upstream, tcpBytes.WithLabelValues(l.Route.Listen, name, "downstream"))
+	}()
+	for range 2 {
+		if err := <-errs; err != nil {
+			// A failed or idle direction ends the whole connection
+			client.Close()
+			upstream.Close()
+		}
+	}
+}
+
+// connect dials a target picked by the pool's balancer, moving on to another
+// target when the connection fails. The balancer sees a stand-in request
+// carrying only the client's address, so hashing balancers keep a client on
+// the same target. The returned function releases the slot reserved on the
+// target.
+func (l *TCPListener) connect(pool *Pool, client net.Conn) (*middleware.ProxyTarget, net.Conn, func()) {
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{},
+		Header:     http.Header{},
+		Host:       l.Route.Listen,
+		RemoteAddr: client.RemoteAddr().String(),
+	}
+	dialer := &net.Dialer{
+		Timeout:   transportConfig().DialTimeout,
+		KeepAlive: transportConfig().KeepAlive,
+	}
+
+	tried := map[*middleware.ProxyTarget]bool{}
+	for range pool.Targets() {
+		target, done := pickTarget(pool.Balancer(), req)
+		if target == nil {
+			break
+		}
+		if tried[target] {
+			done()
+			break
+		}
+		tried[target] = true
+
+		conn, err := dialer.Dial("tcp", target.URL.Host)
+		reportResult(target, err == nil)
+		if err == nil {
+			return target, conn, done
+		}
+		done()
+		tcpConnectErrors.WithLabelValues(l.Route.Listen, target.URL.String()).Inc()
+		fmt.Printf("WARNING: tcp listener on %s: connecting to %s failed: %v\n", l.Route.Listen, target.URL, err)
+	}
+	tcpDropped.WithLabelValues(l.Route.Listen, "no_target").Inc()
+	return nil, nil, nil
+}
+
+// tcpSession is one relayed TCP connection.
+type tcpSession struct {
+	idleTimeout  time.Duration
+	lastActivity atomic.Int64 // unix nanoseconds of the last byte in either direction
+}
+
+// pipe copies src to dst until src is done. An end of stream from src is
+// passed on as a half-close of dst, so the other direction keeps flowing until
+// its own end. Reads time out once neither direction has moved data for the
+// idle timeout.
+func (s *tcpSession) pipe(dst, src net.Conn, bytes prometheus.Counter) error {
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+
+	for {
+		if s.idleTimeout > 0 {
+			src.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		}
+		n, err := src.Read(*buf)
+		if n > 0 {
+			s.lastActivity.Store(time.Now().UnixNano())
+			if s.idleTimeout > 0 {
+				dst.SetWriteDeadline(time.Now().Add(s.idleTimeout))
+			}
+			written, werr := dst.Write((*buf)[:n])
+			bytes.Add(float64(written))
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == nil {
+			continue
+		}
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() &&
+			time.Since(time.Unix(0, s.lastActivity.Load())) < s.idleTimeout {
+			continue // quiet here, but the other direction is busy
+		}
+		if errors.Is(err, io.EOF) {
+			if conn, ok := dst.(interface{ CloseWrite() error }); ok {
+				conn.CloseWrite()
+				return nil
+			}
+		}
+		return err
+	}
+}
@@ -0,0 +1,133 @@
+package manager
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterValue reads the current value of a counter.
+func counterValue(counter prometheus.Counter) float64 {
+	var metric dto.Metric
+	counter.Write(&metric)
+	return metric.GetCounter().GetValue()
+}
+
+// startTCPRelay starts a backend running handle on every connection and a
+// TCP listener relaying to it, returning the listener and the backend's URL.
+func startTCPRelay(t *testing.T, idleTimeout time.Duration, handle func(net.Conn)) (*TCPListener, string) {
+	t.Helper()
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+
+	backendURL := "tcp://" + backend.Addr().String()
+	routes, err := NewRouteTable(helper.Target{
+		Pools: map[string]helper.PoolSpec{"db": {Targets: []helper.TargetSpec{{URL: backendURL}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { upstreamStates.Delete(backendURL) })
+
+	listener := NewTCPListener(&TCPRoute{Listen: "127.0.0.1:0", PoolName: "db", IdleTimeout: idleTimeout}, routes)
+	if err := listener.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(listener.Stop)
+	return listener, backendURL
+}
+
+func TestTCPRelayPassesHalfClose(t *testing.T) {
+	// The backend answers only once the client is done sending
+	listener, backendURL := startTCPRelay(t, time.Minute, func(conn net.Conn) {
+		defer conn.Close()
+		request, err := io.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("received: " + string(request)))
+	})
+
+	client, err := net.Dial("tcp", listener.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("SELECT 1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "received: SELECT 1" {
+		t.Fatalf("response %q after half-close", response)
+	}
+
+	// The counters are updated as the last bytes are written
+	deadline := time.Now().Add(time.Second)
+	for {
+		upstream := counterValue(tcpBytes.WithLabelValues("127.0.0.1:0", backendURL, "upstream"))
+		downstream := counterValue(tcpBytes.WithLabelValues("127.0.0.1:0", backendURL, "downstream"))
+		if upstream == 8 && downstream == float64(len(response)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("counted %v bytes upstream and %v downstream, want 8 and %d", upstream, downstream, len(response))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTCPRelayClosesIdleConnections(t *testing.T) {
+	// The backend holds the connection open without ever sending
+	listener, _ := startTCPRelay(t, 100*time.Millisecond, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	})
+
+	client, err := net.Dial("tcp", listener.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Traffic within the timeout keeps the connection open
+	for range 3 {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("busy connection closed: %v", err)
+		}
+	}
+
+	start := time.Now()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read %v, want the proxy to close the idle connection", err)
+	}
+	if idle := time.Since(start); idle > 2*time.Second {
+		t.Fatalf("idle connection closed after %v", idle)
+	}
+}
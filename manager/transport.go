@@ -0,0 +1,154 @@
+package manager
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// TransportConfig tunes the connection pools kept to the upstream targets.
+type TransportConfig struct {
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration // 0 waits as long as the request context allows
+}
+
+// transportConfig returns the upstream transport settings, read once.
+var transportConfig = sync.OnceValue(func() TransportConfig {
+	config := TransportConfig{
+		MaxIdleConnsPerHost:   64,
+		IdleConnTimeout:       90 * time.Second,
+		DialTimeout:           5 * time.Second,
+		KeepAlive:             30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 0,
+	}
+	if n, err := strconv.Atoi(configs.AppConfig.GetOrDefault("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", "64")); err == nil && n > 0 {
+		config.MaxIdleConnsPerHost = n
+	}
+	for key, setting := range map[string]*time.Duration{
+		"UPSTREAM_IDLE_CONN_TIMEOUT":       &config.IdleConnTimeout,
+		"UPSTREAM_DIAL_TIMEOUT":            &config.DialTimeout,
+		"UPSTREAM_KEEP_ALIVE":              &config.KeepAlive,
+		"UPSTREAM_TLS_HANDSHAKE_TIMEOUT":   &config.TLSHandshakeTimeout,
+		"UPSTREAM_RESPONSE_HEADER_TIMEOUT": &config.ResponseHeaderTimeout,
+	} {
+		value := configs.AppConfig.Get(key)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			fmt.Printf("WARNING: invalid %s, using %v\n", key, *setting)
+			continue
+		}
+		*setting = duration
+	}
+	return config
+})
+
+// newUpstreamTransport creates the long lived transport used for every call to
+// one target, so connections and TLS sessions are reused across requests.
+func newUpstreamTransport(tlsConfig *tls.Config) *http.Transport {
+	config := transportConfig()
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: config.KeepAlive,
+	}
+	return &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// fallbackTransports holds the transports of targets that were not built from
+// targets.json and so carry none in their Meta.
+var fallbackTransports sync.Map
+
+// targetTransport returns the shared transport of the target.
+func targetTransport(target *middleware.ProxyTarget) *http.Transport {
+	if transport, ok := target.Meta["transport"].(*http.Transport); ok {
+		return transport
+	}
+	transport, _ := fallbackTransports.LoadOrStore(target.URL.String(), newUpstreamTransport(targetTLSConfig(target)))
+	return transport.(*http.Transport)
+}
+
+// targetTransports are the transports of one target and the TLS settings
+// they were built with.
+type targetTransports struct {
+	tls         *tls.Config
+	transport   *http.Transport
+	serverNames *serverNameTransports
+}
+
+// upstreamTransports keeps the transports of the targets across reloads, keyed
+// by transportKey, so reloading targets.json leaves the pooled connections and
+// TLS sessions of unchanged targets alone.
+var upstreamTransports = struct {
+	sync.Mutex
+	entries map[string]*targetTransports
+}{entries: map[string]*targetTransports{}}
+
+// transportKey identifies the transports of a target: its URL and TLS settings.
+func transportKey(target *url.URL, spec *helper.TLSSpec) string {
+	settings, _ := json.Marshal(spec)
+	return target.String() + " " + string(settings)
+}
+
+// transportsFor returns the transports kept under key, creating them over
+// tlsConfig the first time the key is seen.
+func transportsFor(key string, tlsConfig *tls.Config) *targetTransports {
+	upstreamTransports.Lock()
+	defer upstreamTransports.Unlock()
+	if entry, ok := upstreamTransports.entries[key]; ok {
+		return entry
+	}
+	entry := &targetTransports{
+		tls:         tlsConfig,
+		transport:   newUpstreamTransport(tlsConfig),
+		serverNames: &serverNameTransports{},
+	}
+	upstreamTransports.entries[key] = entry
+	return entry
+}
+
+// pruneTransports forgets the transports none of the targets uses anymore,
+// after a reload removed or changed their targets, and closes their idle
+// connections. Requests in flight keep their connections.
+func pruneTransports(targets []*middleware.ProxyTarget) {
+	used := map[string]bool{}
+	for _, target := range targets {
+		used[transportKey(target.URL, targetSpec(target).TLS)] = true
+	}
+
+	upstreamTransports.Lock()
+	defer upstreamTransports.Unlock()
+	for key, entry := range upstreamTransports.entries {
+		if used[key] {
+			continue
+		}
+		entry.transport.CloseIdleConnections()
+		entry.serverNames.closeIdle()
+		delete(upstreamTransports.entries, key)
+	}
+}
@@ -0,0 +1,94 @@
+package manager
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+)
+
+// BenchmarkUpstreamTransport compares calling a target through its shared
+// transport with building a new transport per request, as the proxy did
+// before transports were pooled. Run with:
+//
+//	go test ./manager -run '^$' -bench UpstreamTransport
+func BenchmarkUpstreamTransport(b *testing.B) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	for _, upstream := range []struct {
+		name   string
+		server *httptest.Server
+	}{
+		{"http", httptest.NewServer(handler)},
+		{"https", httptest.NewTLSServer(handler)},
+	} {
+		defer upstream.server.Close()
+
+		targets, err := buildTargets([]helper.TargetSpec{{URL: upstream.server.URL}})
+		if err != nil {
+			b.Fatal(err)
+		}
+		target := targets[0]
+
+		b.Run(upstream.name+"/shared", func(b *testing.B) {
+			client := &http.Client{Transport: targetTransport(target)}
+			for b.Loop() {
+				benchmarkGet(b, client, upstream.server.URL)
+			}
+		})
+
+		b.Run(upstream.name+"/per_request", func(b *testing.B) {
+			for b.Loop() {
+				transport := &http.Transport{TLSClientConfig: targetTLSConfig(target)}
+				benchmarkGet(b, &http.Client{Transport: transport}, upstream.server.URL)
+				transport.CloseIdleConnections()
+			}
+		})
+	}
+}
+
+func benchmarkGet(b *testing.B, client *http.Client, url string) {
+	resp, err := client.Get(url)
+	if err != nil {
+		b.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func TestReloadKeepsTransportsOfUnchangedTargets(t *testing.T) {
+	kept := helper.TargetSpec{URL: "http://kept.test:8080"}
+	removed := helper.TargetSpec{URL: "http://removed.test:8080"}
+	before, err := buildTargets([]helper.TargetSpec{kept, removed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pruneTransports(nil) })
+
+	skipVerify := false
+	changed := helper.TargetSpec{URL: removed.URL, TLS: &helper.TLSSpec{InsecureSkipVerify: &skipVerify}}
+	after, err := buildTargets([]helper.TargetSpec{kept, changed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pruneTransports(after)
+
+	if targetTransport(after[0]) != targetTransport(before[0]) {
+		t.Fatal("unchanged target got a new transport on reload")
+	}
+	if targetTransport(after[1]) == targetTransport(before[1]) {
+		t.Fatal("target with changed tls settings kept its old transport")
+	}
+	upstreamTransports.Lock()
+	defer upstreamTransports.Unlock()
+	if _, ok := upstreamTransports.entries[transportKey(before[1].URL, nil)]; ok {
+		t.Fatal("transport of the replaced target was not pruned")
+	}
+	if len(upstreamTransports.entries) != 2 {
+		t.Fatalf("%d transports kept, want 2", len(upstreamTransports.entries))
+	}
+}
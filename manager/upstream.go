@@ -0,0 +1,142 @@
+package manager
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// ewmaDecay is the weight given to the newest latency sample when updating the
+// moving average of a target.
+const ewmaDecay = 0.3
+
+// upstreamState holds the runtime counters the balancers share for one target.
+type upstreamState struct {
+	inflight     atomic.Int64
+	healthy      atomic.Bool
+	ejectedUntil atomic.Int64 // unix nanoseconds until which outlier detection ejected the target
+
+	mu                  sync.Mutex
+	ewma                float64 // moving average of request latency in seconds
+	checkSuccesses      int     // consecutive passed health checks
+	checkFailures       int     // consecutive failed health checks
+	consecutiveFailures int     // consecutive failed requests
+	windowStart         time.Time
+	windowRequests      int // requests in the current outlier detection interval
+	windowFailures      int // failed requests in the current outlier detection interval
+	ejections           int // ejection count, multiplies the ejection time
+}
+
+// upstreamStates keeps the state of every target keyed by its URL, so the
+// counters survive the target list being rebuilt.
+var upstreamStates sync.Map
+
+// stateOf returns the runtime state of the target, creating it on first use.
+func stateOf(target *middleware.ProxyTarget) *upstreamState {
+	key := target.URL.String()
+	if state, ok := upstreamStates.Load(key); ok {
+		return state.(*upstreamState)
+	}
+	fresh := &upstreamState{}
+	fresh.healthy.Store(true)
+	state, _ := upstreamStates.LoadOrStore(key, fresh)
+	return state.(*upstreamState)
+}
+
+// ejected reports whether outlier detection currently ejects the target.
+func (s *upstreamState) ejected(now time.Time) bool {
+	return now.UnixNano() < s.ejectedUntil.Load()
+}
+
+// isAvailable reports whether the target may receive new requests: it passes
+// its health checks, is not ejected and is below its max_connections. The
+// limit is only enforced when reserve takes the slot.
+func isAvailable(target *middleware.ProxyTarget) bool {
+	state := stateOf(target)
+	if limit := targetSpec(target).MaxConnections; limit > 0 && state.Inflight() >= int64(limit) {
+		return false
+	}
+	return state.healthy.Load() && !state.ejected(time.Now())
+}
+
+// availableTargets returns the targets that may receive new requests.
+func availableTargets(targets []*middleware.ProxyTarget) []*middleware.ProxyTarget {
+	available := make([]*middleware.ProxyTarget, 0, len(targets))
+	for _, target := range targets {
+		if isAvailable(target) {
+			available = append(available, target)
+		}
+	}
+	return available
+}
+
+// Inflight returns the number of requests currently outstanding on the target.
+func (s *upstreamState) Inflight() int64 {
+	return s.inflight.Load()
+}
+
+// Latency returns the moving average of the target's request latency in seconds.
+func (s *upstreamState) Latency() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ewma
+}
+
+// observeLatency feeds the time one try took to get response headers from the
+// target into its moving average.
+func (s *upstreamState) observeLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ewma == 0 {
+		s.ewma = d.Seconds()
+		return
+	}
+	s.ewma = ewmaDecay*d.Seconds() + (1-ewmaDecay)*s.ewma
+}
+
+// pickAttempts bounds how often a pick is retried when the picked target
+// filled up before its slot could be reserved.
+const pickAttempts = 3
+
+// reserve takes a slot on the target for a request or a long lived
+// connection, such as a WebSocket session, failing when all of its
+// max_connections are in use. The check and the increment are one atomic
+// step, so concurrent picks cannot overshoot the limit. The returned function
+// releases the slot; calling it more than once is safe.
+func reserve(target *middleware.ProxyTarget) (func(), bool) {
+	state := stateOf(target)
+	limit := int64(targetSpec(target).MaxConnections)
+	for {
+		inflight := state.inflight.Load()
+		if limit > 0 && inflight >= limit {
+			return nil, false
+		}
+		if state.inflight.CompareAndSwap(inflight, inflight+1) {
+			break
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { state.inflight.Add(-1) })
+	}, true
+}
+
+// pickTarget asks the balancer for a target and reserves a slot on it, asking
+// again when the target filled up in between. It returns nil when no target
+// is available; otherwise the returned function must be called once the
+// request or connection is finished.
+func pickTarget(balancer Balancer, r *http.Request) (*middleware.ProxyTarget, func()) {
+	for range pickAttempts {
+		target := balancer.NextTarget(r)
+		if target == nil {
+			return nil, nil
+		}
+		if release, ok := reserve(target); ok {
+			return target, release
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,63 @@
+package manager
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+)
+
+func TestReserveCapsConcurrentRequests(t *testing.T) {
+	targets := testTargets(t, helper.TargetSpec{URL: "http://capped:80", MaxConnections: 5})
+
+	var reserved atomic.Int64
+	releases := make(chan func(), 50)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if release, ok := reserve(targets[0]); ok {
+				reserved.Add(1)
+				releases <- release
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(releases)
+
+	if got := reserved.Load(); got != 5 {
+		t.Fatalf("%d concurrent requests got a slot, want max_connections 5", got)
+	}
+	for release := range releases {
+		release()
+		release() // a second call must not free another slot
+	}
+	if got := stateOf(targets[0]).Inflight(); got != 0 {
+		t.Fatalf("%d requests in flight after all were released", got)
+	}
+}
+
+func TestPickTargetGivesUpOnFullTarget(t *testing.T) {
+	targets := testTargets(t, helper.TargetSpec{URL: "http://single-slot:80", MaxConnections: 1})
+	// A balancer that does not look at the limit, as after a racing pick
+	balancer := fixedBalancer{targets[0]}
+
+	target, release := pickTarget(balancer, nil)
+	if target != targets[0] {
+		t.Fatal("free target not picked")
+	}
+	if target, _ := pickTarget(balancer, nil); target != nil {
+		t.Fatal("picked a target with all of its slots in use")
+	}
+	release()
+	if target, release := pickTarget(balancer, nil); target == nil {
+		t.Fatal("target not picked after its slot was released")
+	} else {
+		release()
+	}
+}
@@ -0,0 +1,447 @@
+package manager
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/configs"
+	"github.com/gorilla/websocket" // Needed for WebSocket support
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	// wsHandshakeTimeout bounds the opening handshake with the target.
+	wsHandshakeTimeout = 10 * time.Second
+	// wsControlWait bounds writing a control frame (close, ping, pong).
+	wsControlWait = 5 * time.Second
+	// wsCloseWait is how long the relay waits for the closing handshake to
+	// finish once one side has closed.
+	wsCloseWait = 5 * time.Second
+	// wsBufferSize is the size of the read and write buffers of each side,
+	// and so of the frames the proxy writes.
+	wsBufferSize = 4096
+)
+
+// wsHandshakeHeaders are set by the WebSocket dialer itself and must not be
+// copied from the client's request.
+var wsHandshakeHeaders = []string{
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
+	"Sec-Websocket-Protocol",
+}
+
+// isWebSocketUpgrade reports whether the request asks to switch to the
+// WebSocket protocol. Both headers are case insensitive and Connection is a
+// list of tokens.
+func isWebSocketUpgrade(req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleWebSocketUpgrade opens a WebSocket to the target first, then upgrades
+// the client and relays frames between the two until either side closes. A
+// target that refuses the handshake has its response passed to the client.
+func handleWebSocketUpgrade(c echo.Context, target *middleware.ProxyTarget) error {
+	clientReq := c.Request()
+
+	targetURL := *target.URL
+	targetURL.Scheme = "ws"
+	if target.URL.Scheme == "https" {
+		targetURL.Scheme = "wss"
+	}
+	backendURL := strings.TrimSuffix(targetURL.String(), "/") + upstreamURI(c)
+
+	// Pass on the client's cookies, auth and other end-to-end headers, minus
+	// the handshake headers the dialer sets itself
+	header := http.Header{}
+	copyRequestHeaders(header, clientReq)
+	for _, name := range wsHandshakeHeaders {
+		header.Del(name)
+	}
+	host := hostPolicyOf(c, target).host(clientReq.Host, target)
+	header.Set("Host", host)
+	ctx := tracePropagator.Extract(clientReq.Context(), propagation.HeaderCarrier(clientReq.Header))
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(header))
+
+	// The frame size limit sits between TLS and the WebSocket framing, so
+	// the TLS handshake is done here rather than by the dialer
+	netDialer := &net.Dialer{
+		Timeout:   transportConfig().DialTimeout,
+		KeepAlive: transportConfig().KeepAlive,
+	}
+	tlsConfig := tlsConfigForHost(target, host)
+	dialer := &websocket.Dialer{
+		ReadBufferSize:  wsBufferSize,
+		WriteBufferSize: wsBufferSize,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := netDialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return newFrameLimitConn(conn, wsConfig.MaxFrameBytes, true), nil
+		},
+		NetDialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := netDialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return newFrameLimitConn(tlsConn, wsConfig.MaxFrameBytes, true), nil
+		},
+		HandshakeTimeout: wsHandshakeTimeout,
+		Subprotocols:     websocket.Subprotocols(clientReq),
+	}
+	targetConn, resp, err := dialer.DialContext(ctx, backendURL, header)
+	if err != nil {
+		reportResult(target, false)
+		if resp != nil {
+			// The target answered without switching protocols, relay its answer
+			return copyResponse(c, resp)
+		}
+		return echo.NewHTTPError(http.StatusBadGateway, "failed to establish WebSocket connection to target: "+err.Error())
+	}
+	reportResult(target, true)
+	defer targetConn.Close()
+
+	// Upgrade the client with the subprotocol and cookies the target chose.
+	// The upgrader only writes responseHeader, so cookies the proxy set
+	// itself, such as the affinity cookie, are carried over as well
+	responseHeader := http.Header{}
+	if protocol := targetConn.Subprotocol(); protocol != "" {
+		responseHeader.Set("Sec-Websocket-Protocol", protocol)
+	}
+	for _, cookie := range c.Response().Header().Values("Set-Cookie") {
+		responseHeader.Add("Set-Cookie", cookie)
+	}
+	for _, cookie := range resp.Header.Values("Set-Cookie") {
+		responseHeader.Add("Set-Cookie", cookie)
+	}
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  wsBufferSize,
+		WriteBufferSize: wsBufferSize,
+		// Checked by admitWebSocket before the target was dialed, again here
+		CheckOrigin: wsConfig.originAllowed,
+	}
+	writer := frameLimitWriter{ResponseWriter: c.Response(), limit: wsConfig.MaxFrameBytes}
+	clientConn, err := upgrader.Upgrade(writer, clientReq, responseHeader)
+	if err != nil {
+		// The upgrader has already answered the client
+		targetConn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(wsControlWait))
+		return nil
+	}
+	defer clientConn.Close()
+
+	relayWebSocket(clientConn, targetConn, target)
+	return nil
+}
+
+// WebSocketConfig holds the liveness checks and limits of relayed WebSocket
+// connections.
+type WebSocketConfig struct {
+	PingInterval    time.Duration // 0 sends no keepalive pings
+	PongTimeout     time.Duration // extra time a peer has to answer a ping
+	IdleTimeout     time.Duration // 0 never closes quiet connections
+	WriteTimeout    time.Duration
+	DrainTimeout    time.Duration // how long shutdown waits for sessions to close
+	MaxMessageBytes int64         // 0 for no limit
+	MaxFrameBytes   int64         // 0 for no limit
+
+	AllowedOrigins      []string // empty allows only the proxy's own host
+	MaxConnectionsPerIP int      // 0 for no limit
+}
+
+// wsConfig is the WebSocket configuration, read from the WS_* settings when
+// the proxy starts.
+var wsConfig = &WebSocketConfig{
+	PingInterval:        30 * time.Second,
+	PongTimeout:         10 * time.Second,
+	IdleTimeout:         10 * time.Minute,
+	WriteTimeout:        10 * time.Second,
+	DrainTimeout:        10 * time.Second,
+	MaxMessageBytes:     1 << 20,
+	MaxFrameBytes:       1 << 20,
+	MaxConnectionsPerIP: 50,
+}
+
+// newWebSocketConfig reads the WebSocket settings.
+func newWebSocketConfig() (*WebSocketConfig, error) {
+	config := *wsConfig
+	for key, setting := range map[string]*time.Duration{
+		"WS_PING_INTERVAL": &config.PingInterval,
+		"WS_PONG_TIMEOUT":  &config.PongTimeout,
+		"WS_IDLE_TIMEOUT":  &config.IdleTimeout,
+		"WS_WRITE_TIMEOUT": &config.WriteTimeout,
+		"WS_DRAIN_TIMEOUT": &config.DrainTimeout,
+	} {
+		value := configs.AppConfig.Get(key)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("invalid %s: %q", key, value)
+		}
+		*setting = duration
+	}
+	if config.WriteTimeout <= 0 {
+		return nil, fmt.Errorf("invalid WS_WRITE_TIMEOUT: %q", configs.AppConfig.Get("WS_WRITE_TIMEOUT"))
+	}
+
+	maxMessage, err := strconv.ParseInt(configs.AppConfig.GetOrDefault("WS_MAX_MESSAGE_BYTES", strconv.FormatInt(config.MaxMessageBytes, 10)), 10, 64)
+	if err != nil || maxMessage < 0 {
+		return nil, fmt.Errorf("invalid WS_MAX_MESSAGE_BYTES: %q", configs.AppConfig.Get("WS_MAX_MESSAGE_BYTES"))
+	}
+	maxFrame, err := strconv.ParseInt(configs.AppConfig.GetOrDefault("WS_MAX_FRAME_BYTES", strconv.FormatInt(config.MaxFrameBytes, 10)), 10, 64)
+	if err != nil || maxFrame < 0 {
+		return nil, fmt.Errorf("invalid WS_MAX_FRAME_BYTES: %q", configs.AppConfig.Get("WS_MAX_FRAME_BYTES"))
+	}
+	config.MaxMessageBytes, config.MaxFrameBytes = maxMessage, maxFrame
+
+	perIP, err := strconv.Atoi(configs.AppConfig.GetOrDefault("WS_MAX_CONNECTIONS_PER_IP", strconv.Itoa(config.MaxConnectionsPerIP)))
+	if err != nil || perIP < 0 {
+		return nil, fmt.Errorf("invalid WS_MAX_CONNECTIONS_PER_IP: %q", configs.AppConfig.Get("WS_MAX_CONNECTIONS_PER_IP"))
+	}
+	config.MaxConnectionsPerIP = perIP
+	config.AllowedOrigins = nil
+	for _, origin := range strings.Split(configs.AppConfig.Get("WS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			config.AllowedOrigins = append(config.AllowedOrigins, origin)
+		}
+	}
+	return &config, nil
+}
+
+// wsPingPayload marks the proxy's own keepalive pings, so the pongs answering
+// them are not relayed to the other side.
+const wsPingPayload = "blue-proxy-keepalive"
+
+// wsSession is one relayed WebSocket connection.
+type wsSession struct {
+	config *WebSocketConfig
+	client *websocket.Conn
+	target *websocket.Conn
+	name   string // the target's URL, as labelled in the metrics
+
+	lastActivity atomic.Int64 // unix nanoseconds of the last data message
+	closing      atomic.Bool  // set once the proxy closes both sides itself
+}
+
+// relayWebSocket pumps frames in both directions. Pings and pongs are passed
+// through, and a close frame from one side is forwarded to the other so the
+// closing handshake runs end to end. Peers that stop answering pings, go quiet
+// for longer than the idle timeout or send oversized messages are closed.
+func relayWebSocket(clientConn, targetConn *websocket.Conn, target *middleware.ProxyTarget) {
+	s := &wsSession{config: wsConfig, client: clientConn, target: targetConn, name: target.URL.String()}
+	if !wsSessions.add(s) {
+		// The proxy started shutting down while the handshake ran
+		s.close(websocket.CloseGoingAway, "server shutting down", wsCloseWait)
+		return
+	}
+	defer wsSessions.remove(s)
+
+	start := time.Now()
+	wsConnections.WithLabelValues(s.name).Inc()
+	defer func() {
+		wsConnections.WithLabelValues(s.name).Dec()
+		wsSessionDuration.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+	}()
+
+	s.lastActivity.Store(start.UnixNano())
+	for _, conn := range []*websocket.Conn{clientConn, targetConn} {
+		if s.config.MaxMessageBytes > 0 {
+			// gorilla answers a too big message with 1009 (Message Too Big)
+			conn.SetReadLimit(s.config.MaxMessageBytes)
+		}
+		s.extendReadDeadline(conn)
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		s.pump(targetConn, clientConn, "upstream")
+		done <- struct{}{}
+	}()
+	go func() {
+		s.pump(clientConn, targetConn, "downstream")
+		done <- struct{}{}
+	}()
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.keepalive(stop)
+
+	// Once one side is done give the other a moment to answer the close
+	<-done
+	timer := time.NewTimer(wsCloseWait)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
+
+// extendReadDeadline gives the peer two ping intervals plus the pong timeout
+// to send anything, when keepalive pings are on, so a ping that goes out a
+// little late still gets its answer in time.
+func (s *wsSession) extendReadDeadline(conn *websocket.Conn) {
+	if s.config.PingInterval > 0 && !s.closing.Load() {
+		conn.SetReadDeadline(time.Now().Add(2*s.config.PingInterval + s.config.PongTimeout))
+	}
+}
+
+// pump copies messages from src to dst until src fails or closes, then
+// forwards the close to dst. Relayed messages and their payload bytes are
+// counted under direction, "upstream" from the client to the target.
+func (s *wsSession) pump(dst, src *websocket.Conn, direction string) {
+	messages := wsMessages.WithLabelValues(s.name, direction)
+	bytes := wsBytes.WithLabelValues(s.name, direction)
+
+	src.SetPingHandler(func(data string) error {
+		s.extendReadDeadline(src)
+		return forwardControl(dst, websocket.PingMessage, []byte(data))
+	})
+	src.SetPongHandler(func(data string) error {
+		s.extendReadDeadline(src)
+		if data == wsPingPayload {
+			return nil // the answer to our own keepalive
+		}
+		return forwardControl(dst, websocket.PongMessage, []byte(data))
+	})
+	// Leave answering a close to the other side, whose reply is relayed back
+	src.SetCloseHandler(func(int, string) error { return nil })
+
+	for {
+		messageType, reader, err := src.NextReader()
+		if err != nil {
+			forwardControl(dst, websocket.CloseMessage, closeMessage(err))
+			return
+		}
+		s.extendReadDeadline(src)
+		s.lastActivity.Store(time.Now().UnixNano())
+
+		dst.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+		writer, err := dst.NextWriter(messageType)
+		if err != nil {
+			return
+		}
+		n, err := io.Copy(writer, reader)
+		bytes.Add(float64(n))
+		if err != nil {
+			// Closing the writer would finish the partial message as if it
+			// were whole, so the close frame follows its fragments instead
+			forwardControl(dst, websocket.CloseMessage, closeMessage(err))
+			return
+		}
+		if err := writer.Close(); err != nil {
+			return
+		}
+		messages.Inc()
+	}
+}
+
+// keepalive pings both peers every PingInterval and closes the session once
+// it has been idle for too long, until stop is closed. Pings and idle checks
+// run on their own tickers so an early idle tick never delays a ping.
+func (s *wsSession) keepalive(stop <-chan struct{}) {
+	var pings, idleChecks <-chan time.Time
+	if s.config.PingInterval > 0 {
+		ticker := time.NewTicker(s.config.PingInterval)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	if period := s.config.IdleTimeout / 4; period > 0 {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		idleChecks = ticker.C
+	}
+	if pings == nil && idleChecks == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-pings:
+			forwardControl(s.client, websocket.PingMessage, []byte(wsPingPayload))
+			forwardControl(s.target, websocket.PingMessage, []byte(wsPingPayload))
+		case now := <-idleChecks:
+			if now.Sub(time.Unix(0, s.lastActivity.Load())) >= s.config.IdleTimeout {
+				s.close(websocket.CloseGoingAway, "idle timeout", wsCloseWait)
+				return
+			}
+		}
+	}
+}
+
+// close sends a close frame to both peers and gives them wait to answer
+// before their reads fail.
+func (s *wsSession) close(code int, text string, wait time.Duration) {
+	s.closing.Store(true)
+	for _, conn := range []*websocket.Conn{s.client, s.target} {
+		forwardControl(conn, websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
+		conn.SetReadDeadline(time.Now().Add(wait))
+	}
+}
+
+// forwardControl writes a control frame, treating a connection that already
+// sent its close frame as success.
+func forwardControl(conn *websocket.Conn, messageType int, data []byte) error {
+	err := conn.WriteControl(messageType, data, time.Now().Add(wsControlWait))
+	if errors.Is(err, websocket.ErrCloseSent) {
+		return nil
+	}
+	return err
+}
+
+// closeMessage returns the close frame to send to the other side after reading
+// err. The peer's own close code and reason are kept, an oversized message or
+// frame is reported as 1009 (Message Too Big), and codes that must not appear
+// on the wire, a dropped connection or a timeout become 1001 (Going Away).
+func closeMessage(err error) []byte {
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "message too big")
+	}
+	if errors.Is(err, errFrameTooBig) {
+		return websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "frame too big")
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return websocket.FormatCloseMessage(websocket.CloseGoingAway, "peer timed out")
+	}
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		switch closeErr.Code {
+		case websocket.CloseNoStatusReceived:
+			return websocket.FormatCloseMessage(websocket.CloseNoStatusReceived, "")
+		case websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+		default:
+			return websocket.FormatCloseMessage(closeErr.Code, closeErr.Text)
+		}
+	}
+	return websocket.FormatCloseMessage(websocket.CloseGoingAway, "peer went away")
+}
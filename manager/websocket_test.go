@@ -0,0 +1,233 @@
+package manager
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// relayToBackend starts a backend reporting the outcome of the first message
+// it reads and a proxy relaying WebSockets to it, returning the proxy's URL.
+func relayToBackend(t *testing.T, config WebSocketConfig) (string, <-chan error, <-chan int) {
+	t.Helper()
+	previous := wsConfig
+	wsConfig = &config
+	t.Cleanup(func() { wsConfig = previous })
+
+	readErrs := make(chan error, 1)
+	readSizes := make(chan int, 1)
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			readErrs <- err
+			return
+		}
+		readSizes <- len(message)
+	}))
+	t.Cleanup(backend.Close)
+
+	targets, err := buildTargets([]helper.TargetSpec{{URL: backend.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := echo.New()
+	app.Any("/*", func(c echo.Context) error {
+		return handleWebSocketUpgrade(c, targets[0])
+	})
+	proxy := httptest.NewServer(app)
+	t.Cleanup(proxy.Close)
+	return "ws" + strings.TrimPrefix(proxy.URL, "http") + "/", readErrs, readSizes
+}
+
+func TestOversizedFragmentedMessageIsNotDeliveredInPart(t *testing.T) {
+	config := *wsConfig
+	config.MaxMessageBytes = 4500
+	url, readErrs, readSizes := relayToBackend(t, config)
+
+	client, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// The default 4096 byte write buffer sends this as two fragments
+	if err := client.WriteMessage(websocket.BinaryMessage, make([]byte, 5000)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case size := <-readSizes:
+		t.Fatalf("backend got a %d byte message out of an oversized one", size)
+	case err := <-readErrs:
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseMessageTooBig {
+			t.Fatalf("backend read %v, want close 1009", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend got nothing")
+	}
+}
+
+func TestFrameOverLimitClosesWith1009(t *testing.T) {
+	config := *wsConfig
+	config.MaxMessageBytes, config.MaxFrameBytes = 1<<20, 1000
+	url, readErrs, readSizes := relayToBackend(t, config)
+
+	// A small write buffer splits the message into frames under the limit
+	fragmenting := &websocket.Dialer{WriteBufferSize: 512}
+	small, _, err := fragmenting.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer small.Close()
+	if err := small.WriteMessage(websocket.BinaryMessage, make([]byte, 3000)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case size := <-readSizes:
+		if size != 3000 {
+			t.Fatalf("backend got %d bytes, want 3000", size)
+		}
+	case err := <-readErrs:
+		t.Fatalf("message in small frames refused: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend got nothing")
+	}
+
+	// The default 4096 byte write buffer sends this as a single frame
+	large, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer large.Close()
+	if err := large.WriteMessage(websocket.BinaryMessage, make([]byte, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case size := <-readSizes:
+		t.Fatalf("backend got a %d byte message sent in a frame over the limit", size)
+	case err := <-readErrs:
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseMessageTooBig {
+			t.Fatalf("backend read %v, want close 1009", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend got nothing")
+	}
+}
+
+func TestFrameLimitConnSkipsHandshakeResponse(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	conn := newFrameLimitConn(client, 100, true)
+	defer conn.Close()
+
+	go func() {
+		// The handshake response and a 5 byte frame, then a 200 byte frame
+		server.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n\x82\x05hello"))
+		server.Write([]byte("\x82\x7e\x00\xc8"))
+	}()
+
+	buf := make([]byte, 512)
+	var err error
+	read := 0
+	for err == nil {
+		var n int
+		n, err = conn.Read(buf)
+		read += n
+	}
+	if !errors.Is(err, errFrameTooBig) {
+		t.Fatalf("read error %v, want errFrameTooBig", err)
+	}
+	if read == 0 {
+		t.Fatal("the handshake and the small frame were not passed through")
+	}
+}
+
+func TestIdleSessionSurvivesKeepalivePings(t *testing.T) {
+	config := *wsConfig
+	config.PingInterval, config.PongTimeout, config.IdleTimeout = 50*time.Millisecond, 20*time.Millisecond, 0
+	url, readErrs, readSizes := relayToBackend(t, config)
+
+	client, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// Reading lets the client answer the proxy's pings
+	clientErrs := make(chan error, 1)
+	go func() {
+		_, _, err := client.ReadMessage()
+		clientErrs <- err
+	}()
+
+	select {
+	case err := <-clientErrs:
+		t.Fatalf("idle session closed: %v", err)
+	case err := <-readErrs:
+		t.Fatalf("idle session closed: %v", err)
+	case <-time.After(20 * config.PingInterval):
+	}
+
+	if err := client.WriteMessage(websocket.TextMessage, []byte("still here")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case size := <-readSizes:
+		if size != len("still here") {
+			t.Fatalf("backend got %d bytes", size)
+		}
+	case err := <-readErrs:
+		t.Fatalf("backend read %v after idling", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend got nothing")
+	}
+}
+
+func TestUpgradeResponseCarriesProxyCookies(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, http.Header{"Set-Cookie": {"session=backend"}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+	}))
+	defer backend.Close()
+	targets := testTargets(t, helper.TargetSpec{URL: backend.URL})
+
+	app := echo.New()
+	app.Any("/*", func(c echo.Context) error {
+		c.SetCookie(&http.Cookie{Name: "affinity", Value: "pinned"})
+		return handleWebSocketUpgrade(c, targets[0])
+	})
+	proxy := httptest.NewServer(app)
+	defer proxy.Close()
+
+	client, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxy.URL, "http")+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	cookies := map[string]string{}
+	for _, cookie := range resp.Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+	if cookies["affinity"] != "pinned" || cookies["session"] != "backend" {
+		t.Fatalf("upgrade response cookies %v, want the proxy's and the target's", cookies)
+	}
+}
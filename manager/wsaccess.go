@@ -0,0 +1,190 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bushubdegefu/blue-proxy/helper"
+	"github.com/labstack/echo/v4"
+)
+
+// ForwardAuth is a compiled AuthSpec.
+type ForwardAuth struct {
+	URL     string
+	Timeout time.Duration
+}
+
+// newForwardAuth validates an auth check, nil when there is none.
+func newForwardAuth(spec *helper.AuthSpec) (*ForwardAuth, error) {
+	if spec == nil {
+		return nil, nil
+	}
+	u, err := url.Parse(spec.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid auth url %q", spec.URL)
+	}
+	timeout := 5 * time.Second
+	if spec.Timeout != "" {
+		timeout, err = time.ParseDuration(spec.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid auth timeout %q", spec.Timeout)
+		}
+	}
+	return &ForwardAuth{URL: spec.URL, Timeout: timeout}, nil
+}
+
+// authClient calls the auth services; their redirects are answers, not
+// something to follow.
+var authClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Check asks the auth service about the request, returning an error carrying
+// the status for the client when it is refused. The challenge of a 401 is
+// passed on to the client.
+func (a *ForwardAuth) Check(c echo.Context) error {
+	req := c.Request()
+	ctx, cancel := context.WithTimeout(req.Context(), a.Timeout)
+	defer cancel()
+
+	authReq, err := http.NewRequestWithContext(ctx, http.MethodGet, a.URL, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "invalid auth request")
+	}
+	for _, name := range []string{"Authorization", "Cookie"} {
+		for _, value := range req.Header.Values(name) {
+			authReq.Header.Add(name, value)
+		}
+	}
+	authReq.Header.Set("X-Original-Method", req.Method)
+	authReq.Header.Set("X-Original-URI", req.RequestURI)
+	setForwardedHeaders(authReq.Header, req)
+
+	resp, err := authClient.Do(authReq)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, "auth check failed")
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		if challenge := resp.Header.Get("WWW-Authenticate"); challenge != "" {
+			c.Response().Header().Set("WWW-Authenticate", challenge)
+		}
+		return echo.NewHTTPError(http.StatusUnauthorized, "unauthorized")
+	}
+	return echo.NewHTTPError(http.StatusForbidden, "forbidden")
+}
+
+// originAllowed reports whether a WebSocket upgrade may come from the request's
+// Origin. Requests without an Origin are not from a browser and are allowed.
+// Without an allowlist only the proxy's own host is accepted.
+func (w *WebSocketConfig) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if len(w.AllowedOrigins) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	for _, pattern := range w.AllowedOrigins {
+		if originMatches(pattern, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// originMatches matches an origin against an allowlist entry: "*", a host
+// ("app.example.com", "*.example.com") or a scheme and host
+// ("https://*.example.com:8443"). A host without a port matches any port.
+func originMatches(pattern string, origin *url.URL) bool {
+	if pattern == "*" {
+		return true
+	}
+	host := pattern
+	if scheme, rest, ok := strings.Cut(pattern, "://"); ok {
+		if !strings.EqualFold(scheme, origin.Scheme) {
+			return false
+		}
+		host = rest
+	}
+
+	candidate := origin.Hostname()
+	if strings.Contains(strings.TrimPrefix(host, "*."), ":") {
+		candidate = origin.Host
+	}
+	candidate, host = strings.ToLower(candidate), strings.ToLower(host)
+	if strings.HasPrefix(host, "*.") {
+		return strings.HasSuffix(candidate, host[1:])
+	}
+	return candidate == host
+}
+
+// wsClients counts the open WebSocket connections of every client IP.
+var wsClients = &connectionCounter{counts: map[string]int{}}
+
+type connectionCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// acquire takes a connection slot for key, failing when limit slots are taken.
+// A limit of 0 means no limit.
+func (c *connectionCounter) acquire(key string, limit int) (func(), bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if limit > 0 && c.counts[key] >= limit {
+		return nil, false
+	}
+	c.counts[key]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.counts[key]--; c.counts[key] <= 0 {
+				delete(c.counts, key)
+			}
+		})
+	}, true
+}
+
+// admitWebSocket runs the checks a WebSocket upgrade must pass before it is
+// relayed: the Origin allowlist, the per client IP connection limit and the
+// route's auth check. The returned function frees the connection slot.
+func admitWebSocket(c echo.Context, route *Route) (func(), error) {
+	req := c.Request()
+	if wsSessions.isDraining() {
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable, "server shutting down")
+	}
+	if !wsConfig.originAllowed(req) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "websocket origin not allowed")
+	}
+
+	release, ok := wsClients.acquire(clientIP(req), wsConfig.MaxConnectionsPerIP)
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusTooManyRequests, "too many websocket connections")
+	}
+
+	if route.WebSocketAuth != nil {
+		if err := route.WebSocketAuth.Check(c); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
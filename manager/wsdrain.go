@@ -0,0 +1,90 @@
+package manager
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsSessions holds the relayed WebSocket sessions. Their connections are
+// hijacked from the HTTP server, so its Shutdown neither sees nor waits for
+// them; drain closes them instead.
+var wsSessions = &sessionRegistry{sessions: map[*wsSession]struct{}{}}
+
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[*wsSession]struct{}
+	draining bool
+	wg       sync.WaitGroup
+}
+
+// add registers a session, failing once the proxy has started draining.
+func (r *sessionRegistry) add(s *wsSession) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining {
+		return false
+	}
+	r.sessions[s] = struct{}{}
+	r.wg.Add(1)
+	return true
+}
+
+// remove unregisters a session once its relay has returned.
+func (r *sessionRegistry) remove(s *wsSession) {
+	r.mu.Lock()
+	delete(r.sessions, s)
+	r.mu.Unlock()
+	r.wg.Done()
+}
+
+// isDraining reports whether new sessions are being turned away.
+func (r *sessionRegistry) isDraining() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.draining
+}
+
+// drain stops accepting sessions, sends both peers of every open session a
+// 1001 (Going Away) close frame and waits up to timeout for the closing
+// handshakes to finish. Sessions still open after that are cut.
+func (r *sessionRegistry) drain(timeout time.Duration) {
+	r.mu.Lock()
+	r.draining = true
+	open := make([]*wsSession, 0, len(r.sessions))
+	for s := range r.sessions {
+		open = append(open, s)
+	}
+	r.mu.Unlock()
+	if len(open) == 0 {
+		return
+	}
+
+	fmt.Printf("INFO: closing %d WebSocket connections\n", len(open))
+	for _, s := range open {
+		go s.close(websocket.CloseGoingAway, "server shutting down", timeout)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Printf("WARNING: %d WebSocket connections did not close within %s\n", len(r.sessions), timeout)
+	for s := range r.sessions {
+		s.client.Close()
+		s.target.Close()
+	}
+}
@@ -0,0 +1,124 @@
+package manager
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// errFrameTooBig fails the reads of a frameLimitConn once the peer starts a
+// frame over the limit.
+var errFrameTooBig = errors.New("websocket: frame too big")
+
+// frameLimitConn fails reads once the peer starts a WebSocket frame with a
+// payload over limit. gorilla/websocket only limits whole messages, so the
+// frame headers are followed on the raw byte stream. A connection dialed by
+// the proxy starts with the target's handshake response, which is skipped.
+type frameLimitConn struct {
+	net.Conn
+	limit int64
+
+	handshake  bool // still in the HTTP handshake response
+	matched    int  // bytes of the blank line ending the handshake seen
+	header     [14]byte
+	headerLen  int
+	headerSize int
+	remaining  int64 // payload bytes left in the current frame
+	err        error
+}
+
+// newFrameLimitConn wraps conn, or returns it as is when limit is 0.
+func newFrameLimitConn(conn net.Conn, limit int64, handshake bool) net.Conn {
+	if limit <= 0 {
+		return conn
+	}
+	return &frameLimitConn{Conn: conn, limit: limit, handshake: handshake}
+}
+
+func (f *frameLimitConn) Read(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	n, err := f.Conn.Read(p)
+	if scanErr := f.scan(p[:n]); scanErr != nil {
+		f.err = scanErr
+		return 0, scanErr
+	}
+	return n, err
+}
+
+// scan follows the frames in b, failing on a frame header over the limit.
+func (f *frameLimitConn) scan(b []byte) error {
+	const endOfHeaders = "\r\n\r\n"
+	for len(b) > 0 {
+		switch {
+		case f.handshake:
+			switch {
+			case b[0] == endOfHeaders[f.matched]:
+				f.matched++
+			case b[0] == '\r':
+				f.matched = 1
+			default:
+				f.matched = 0
+			}
+			b = b[1:]
+			f.handshake = f.matched < len(endOfHeaders)
+		case f.remaining > 0:
+			n := min(int64(len(b)), f.remaining)
+			f.remaining -= n
+			b = b[n:]
+		default:
+			f.header[f.headerLen] = b[0]
+			f.headerLen++
+			b = b[1:]
+			if f.headerLen == 2 {
+				// RFC 6455 section 5.2: 7 bit length, or 16 or 64 bit
+				// extended length, then the masking key
+				f.headerSize = 2
+				switch f.header[1] & 0x7f {
+				case 126:
+					f.headerSize += 2
+				case 127:
+					f.headerSize += 8
+				}
+				if f.header[1]&0x80 != 0 {
+					f.headerSize += 4
+				}
+			}
+			if f.headerLen < 2 || f.headerLen < f.headerSize {
+				continue
+			}
+
+			length := int64(f.header[1] & 0x7f)
+			switch length {
+			case 126:
+				length = int64(binary.BigEndian.Uint16(f.header[2:4]))
+			case 127:
+				length = int64(binary.BigEndian.Uint64(f.header[2:10]))
+			}
+			if length < 0 || length > f.limit {
+				return errFrameTooBig
+			}
+			f.remaining = length
+			f.headerLen = 0
+		}
+	}
+	return nil
+}
+
+// frameLimitWriter hands the WebSocket upgrader the hijacked client
+// connection wrapped in a frameLimitConn.
+type frameLimitWriter struct {
+	http.ResponseWriter
+	limit int64
+}
+
+func (w frameLimitWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return newFrameLimitConn(conn, w.limit, false), rw, nil
+}
@@ -65,8 +65,11 @@ func EchoAppSpanner(ctx echo.Context, span_name string) (context.Context, oteltr
 	gen, _ := uuid.NewV7()
 	id := gen.String()
 
+	// continue the trace of the client when it sent a W3C trace context
+	parent := otel.GetTextMapPropagator().Extract(ctx.Request().Context(), propagation.HeaderCarrier(ctx.Request().Header))
+
 	//  getting request body
-	trace, span := AppTracer.Start(ctx.Request().Context(), span_name,
+	trace, span := AppTracer.Start(parent, span_name,
 		oteltrace.WithAttributes(attribute.String("id", id)),
 		// oteltrace.WithAttributes(attribute.String("request", string(ctx.Request().RequestURI))),
 	)